@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// options holds everything parsed from the command line.
+type options struct {
+	command       string
+	contextID     string
+	configFile    string
+	cwd           string
+	promptContext string
+	promptShell   string
+	side          string
+	exitStatus    int
+	reveal        int
+	active        string
+	query         string
+	format        string
+	parallel      int
+	timeout       time.Duration
+	envType       string
+	source        string
+	envs          []string
+	rest          []string
+
+	// dashes is the index in rest of the first word after "--", or -1
+	dashes int
+
+	help           bool
+	quiet          bool
+	strict         bool
+	all            bool
+	envCount       bool
+	paths          bool
+	sorted         bool
+	reverse        bool
+	showSecrets    bool
+	includeSecrets bool
+	jsonTree       bool
+	json           bool
+	login          bool
+	long           bool
+	noFzf          bool
+	activeOnly     bool
+	printConfig    bool
+	interactive    bool
+}
+
+// commands are the command words parseArgs recognizes.
+var commands = []string{
+	"set", "exec", "run", "prompt", "list", "dump", "edit", "validate", "doctor", "graph",
+	"clear-cache", "shell-init", "up", "parent", "do", "env", "add-context", "add-env", "rename", "merge", "history", "freeze", "changed", "help", "version",
+}
+
+// matchCommand returns the command arg names, either exactly or as an
+// unambiguous prefix. An empty command is returned when arg names none.
+func matchCommand(arg string) (string, error) {
+	var matches []string
+	for _, command := range commands {
+		if command == arg {
+			return command, nil
+		}
+
+		if strings.HasPrefix(command, arg) {
+			matches = append(matches, command)
+		}
+	}
+
+	if len(matches) > 1 {
+		return "", fmt.Errorf("command %s is ambiguous: %s", arg, strings.Join(matches, ", "))
+	}
+
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+
+	return "", nil
+}
+
+// parseArgs parses the command line, without the binary name. The first
+// command word found, or unambiguous prefix of one, is the command, flags may
+// come before or after it, and everything after "--" is passed through as
+// is. Unknown flags and extra words are left in rest for the command to
+// handle.
+func parseArgs(args []string) (*options, error) {
+	opts := &options{dashes: -1, exitStatus: -1}
+	expectContext := false
+
+	value := func(i int) (string, error) {
+		if i+1 >= len(args) {
+			return "", fmt.Errorf("flag %s needs a value", args[i])
+		}
+		return args[i+1], nil
+	}
+
+	for i := 0; i < len(args) && !opts.help; i++ {
+		arg := args[i]
+
+		if expectContext && !strings.HasPrefix(arg, "-") {
+			opts.contextID = arg
+			expectContext = false
+			continue
+		}
+
+		switch arg {
+		case "-C", "-q", "-query", "--query", "-config", "--config", "-context", "--context", "-cwd", "--cwd", "-env", "--env", "-format", "--format", "-parallel", "--parallel", "-type", "--type", "-source", "--source", "-timeout", "--timeout", "-side", "--side", "-shell", "--shell", "-exit-status", "--exit-status", "-reveal", "--reveal":
+			val, err := value(i)
+			if err != nil {
+				return nil, err
+			}
+			i++
+
+			switch strings.TrimLeft(arg, "-") {
+			case "C":
+				opts.active = val
+			case "q", "query":
+				opts.query = val
+			case "config":
+				opts.configFile = val
+			case "context":
+				opts.promptContext = val
+			case "cwd":
+				opts.cwd = val
+			case "env":
+				opts.envs = append(opts.envs, val)
+			case "format":
+				opts.format = val
+			case "type":
+				opts.envType = val
+			case "source":
+				opts.source = val
+			case "shell":
+				if val != "bash" && val != "zsh" && val != "fish" {
+					return nil, fmt.Errorf("--shell %s is not bash, zsh or fish", val)
+				}
+				opts.promptShell = val
+			case "side":
+				if val != "left" && val != "right" {
+					return nil, fmt.Errorf("--side %s is not left or right", val)
+				}
+				opts.side = val
+			case "timeout":
+				d, err := time.ParseDuration(val)
+				if err != nil || d <= 0 {
+					return nil, fmt.Errorf("--timeout %s is not a positive duration", val)
+				}
+				opts.timeout = d
+			case "reveal":
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("--reveal %s is not a number of characters", val)
+				}
+				opts.reveal = n
+			case "exit-status":
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("--exit-status %s is not an exit status", val)
+				}
+				opts.exitStatus = n
+			case "parallel":
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("--parallel %s is not a positive number", val)
+				}
+				opts.parallel = n
+			}
+		case "--":
+			opts.dashes = len(opts.rest)
+			opts.rest = append(opts.rest, args[i+1:]...)
+			return opts, nil
+		case "-help", "--help":
+			opts.help = true
+		case "-version", "--version":
+			opts.command = "version"
+		case "-quiet", "--quiet":
+			opts.quiet = true
+		case "-strict", "--strict":
+			opts.strict = true
+		case "-all", "--all":
+			opts.all = true
+		case "-env-count", "--env-count":
+			opts.envCount = true
+		case "-paths", "--paths":
+			opts.paths = true
+		case "-sort", "--sort":
+			opts.sorted = true
+		case "-reverse", "--reverse":
+			opts.reverse = true
+		case "-json", "--json":
+			opts.json = true
+		case "-json-tree", "--json-tree":
+			opts.jsonTree = true
+		case "-long", "--long":
+			opts.long = true
+		case "-login", "--login":
+			opts.login = true
+		case "-t", "-interactive", "--interactive":
+			opts.interactive = true
+		case "-no-fzf", "--no-fzf":
+			opts.noFzf = true
+		case "-active-only", "--active-only":
+			opts.activeOnly = true
+		case "-print-config", "--print-config":
+			opts.printConfig = true
+		case "-show-secrets", "--show-secrets":
+			opts.showSecrets = true
+		case "-include-secrets", "--include-secrets":
+			opts.includeSecrets = true
+		default:
+			if opts.command == "" && !strings.HasPrefix(arg, "-") {
+				command, err := matchCommand(arg)
+				if err != nil {
+					return nil, err
+				}
+
+				if command != "" {
+					opts.command = command
+					expectContext = command == "set" || command == "exec" || command == "run"
+					continue
+				}
+			}
+
+			opts.rest = append(opts.rest, arg)
+		}
+	}
+
+	return opts, nil
+}
+
+// commandUsage describes the arguments and flags of every command for
+// ctx <command> --help.
+var commandUsage = map[string]string{
+	"set": `usage: ctx [set] [--query <text>] [--no-fzf] [<context>]
+
+  start a shell in context, a path relative to the active context or from
+  the top level when it starts with /. without a context, one is picked
+  with ` + fzfCommand + `, or from a numbered menu when it is not installed.
+  KEY=VALUE lines piped in on stdin are added to the environment of the
+  shell.
+
+  -q, --query <text> open the picker filtered by text
+  --no-fzf           use the numbered menu even when ` + fzfCommand + ` is installed`,
+	"exec": `usage: ctx exec [--cwd <dir>] [--env KEY=VALUE]... [--login] [--interactive] [--timeout <duration>] <context> [-- <command>]
+
+  run command in context, the default_command of context without one.
+
+  --cwd <dir>        run the command in dir
+  --env KEY=VALUE    add a variable to the environment, may be repeated
+  --login            run the command through a login shell of $SHELL
+  -t, --interactive  run the command on a pseudo terminal, even when ctx
+                     has none
+  --timeout <d>      kill the command after d, e.g. 30s, and exit with 124`,
+	"history": `usage: ctx history [<n>]
+
+  list the recent context switches, most recent first. with n, enter the
+  context of switch n again.`,
+	"merge": `usage: ctx merge <context> <context>... -- <command>
+
+  run command with the environments of all contexts, later contexts
+  overriding earlier ones. the last context is the active one.`,
+	"run": `usage: ctx run <context> -- <command>
+
+  replace ctx with command, run in context, so no ctx process stays around
+  while it runs. where that is not possible, ctx waits for it like exec.`,
+	"prompt": `usage: ctx prompt [--context <path>] [--side left|right] [--exit-status <n>] [--shell bash|zsh|fish]
+
+  print the prompt of the active context.
+
+  --context <path>        print the prompt of the full context path instead
+  --side left|right       print prompt_left or prompt_right instead of prompt
+  --exit-status <n>       start the prompt with a green or red mark for the
+                          exit status of the last command, pass $?
+  --shell bash|zsh|fish   wrap color codes in the markers the shell needs to
+                          tell the width of the prompt`,
+	"list": `usage: ctx list [--all] [--paths] [--sort] [--reverse] [--long] [--json-tree] [--active-only]
+
+  list the contexts below the active context.
+
+  --all              list every context below, as relative paths
+  --paths            print full paths, starting with / inside a context
+  --sort             sort the output
+  --reverse          reverse the output
+  --long             add columns for the number of envs, whether there are
+                     sub contexts (+) and the description
+  --json-tree        print the whole tree as nested JSON
+  --reveal <n>       keep n characters visible at either end of masked
+                     sources in --json-tree
+  --active-only      print only the IDs of the children of the active
+                     context, never paged, for scripts`,
+	"dump": `usage: ctx dump [--format hcl|json]
+
+  print the config file.
+
+  --format json      print the parsed config as JSON instead, without
+                     expressions such as transform and when`,
+	"changed": `usage: ctx changed
+
+  print the files of file and dotenv envs of the active context that
+  changed since its shell was started, for a context that sets watch.
+  exits with 1 when none did.`,
+	"help": `usage: ctx help [<context>|<command>]
+
+  describe context from the config without resolving anything: its
+  description, the names and types of its envs, its commands and its sub
+  contexts. a command, when no context is called so, is described as by
+  ctx <command> --help. without an argument, print the usage of all
+  commands.`,
+	"freeze": `usage: ctx freeze [--include-secrets] [<context>]
+
+  print a config defining context, or every context, and its sub contexts
+  again with the resolved values of their envs as static sources.
+
+  --include-secrets  keep secret envs instead of leaving them out`,
+	"edit": `usage: ctx edit
+
+  open the config file in $EDITOR.`,
+	"add-context": `usage: ctx add-context <path>
+
+  add an empty context at path to the config files, in the file defining
+  its parent.`,
+	"add-env": `usage: ctx add-env [--type <type>] [--source <source>] <context> <id>
+
+  add an env to context in the config files.
+
+  --type <type>      type of the env, static when left out
+  --source <source>  source of the env`,
+	"rename": `usage: ctx rename <context> <id>
+
+  change the ID of context in the config files, together with every
+  extends that refers to it. formatting and comments are kept.`,
+	"validate": `usage: ctx validate
+
+  parse the config and report errors, including unknown env types and IDs
+  defined twice.`,
+	"doctor": `usage: ctx doctor
+
+  check the config and the tools ctx depends on.`,
+	"graph": `usage: ctx graph [--env-count]
+
+  print the context tree as a DOT graph.
+
+  --env-count        label contexts with their number of envs`,
+	"clear-cache": `usage: ctx clear-cache [<context> [<env>]]
+
+  remove cached values, of every env or only those of context or env.
+  context is resolved like in set, relative to the active context.`,
+	"shell-init": `usage: ctx shell-init <bash|zsh|fish>
+
+  print the prompt integration for a shell.`,
+	"up": `usage: ctx up
+
+  start a shell in the parent of the active context. the new shell runs
+  inside the current one, so exit returns to the child context. a top
+  level context is left with exit.`,
+	"do": `usage: ctx do [<context>] [<command>]
+
+  run a named command of context, the active context by default. without
+  a command, list the commands; a single argument that is no command of the
+  active context lists the commands of that context.`,
+	"env": `usage: ctx env [--show-secrets] [--reveal <n>] [--json] [<context>]
+       ctx env list [<context>]
+
+  print the variables context defines, the active context by default.
+  env list prints only the IDs and types of its envs, resolving nothing.
+
+  --show-secrets     print secret values instead of masking them
+  --reveal <n>       keep n characters visible at either end of masked
+                     values long enough to still hide most of them
+  --json             print a JSON object of names and values`,
+	"version": `usage: ctx version
+
+  print the version of ctx.`,
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		command    string
+		contextID  string
+		configFile string
+		rest       []string
+		dashes     int
+		err        string
+	}{
+		{
+			name:      "command and context",
+			args:      []string{"set", "prod"},
+			command:   "set",
+			contextID: "prod",
+			dashes:    -1,
+		},
+		{
+			name:       "flag before the command",
+			args:       []string{"--config", "c.hcl", "set", "prod"},
+			command:    "set",
+			contextID:  "prod",
+			configFile: "c.hcl",
+			dashes:     -1,
+		},
+		{
+			name:       "flag after the command",
+			args:       []string{"set", "prod", "-config", "c.hcl"},
+			command:    "set",
+			contextID:  "prod",
+			configFile: "c.hcl",
+			dashes:     -1,
+		},
+		{
+			name:       "flag between command and context",
+			args:       []string{"exec", "--config", "c.hcl", "prod"},
+			command:    "exec",
+			contextID:  "prod",
+			configFile: "c.hcl",
+			dashes:     -1,
+		},
+		{
+			name: "value flag at the end",
+			args: []string{"set", "prod", "-config"},
+			err:  "flag -config needs a value",
+		},
+		{
+			name:    "unknown flag",
+			args:    []string{"list", "--bogus"},
+			command: "list",
+			rest:    []string{"--bogus"},
+			dashes:  -1,
+		},
+		{
+			name:      "everything after dashes is passed through",
+			args:      []string{"exec", "prod", "--", "ls", "--config", "x", "--"},
+			command:   "exec",
+			contextID: "prod",
+			rest:      []string{"ls", "--config", "x", "--"},
+			dashes:    0,
+		},
+		{
+			name:    "words before dashes",
+			args:    []string{"merge", "a", "b", "--", "env"},
+			command: "merge",
+			rest:    []string{"a", "b", "env"},
+			dashes:  2,
+		},
+		{
+			name:    "dashes at the end",
+			args:    []string{"do", "--"},
+			command: "do",
+			dashes:  0,
+		},
+		{
+			name:    "command prefix",
+			args:    []string{"li", "--all"},
+			command: "list",
+			dashes:  -1,
+		},
+		{
+			name: "ambiguous command prefix",
+			args: []string{"e"},
+			err:  "command e is ambiguous",
+		},
+		{
+			name:    "only the first command word is the command",
+			args:    []string{"do", "list"},
+			command: "do",
+			rest:    []string{"list"},
+			dashes:  -1,
+		},
+		{
+			name: "invalid value",
+			args: []string{"exec", "--timeout", "soon", "prod"},
+			err:  "--timeout soon is not a positive duration",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := parseArgs(test.args)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if opts.command != test.command {
+				t.Errorf("command = %q, want %q", opts.command, test.command)
+			}
+			if opts.contextID != test.contextID {
+				t.Errorf("contextID = %q, want %q", opts.contextID, test.contextID)
+			}
+			if opts.configFile != test.configFile {
+				t.Errorf("configFile = %q, want %q", opts.configFile, test.configFile)
+			}
+			if !reflect.DeepEqual(opts.rest, test.rest) {
+				t.Errorf("rest = %q, want %q", opts.rest, test.rest)
+			}
+			if opts.dashes != test.dashes {
+				t.Errorf("dashes = %d, want %d", opts.dashes, test.dashes)
+			}
+		})
+	}
+}
+
+func TestParseArgsHelp(t *testing.T) {
+	opts, err := parseArgs([]string{"exec", "--help", "--timeout"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !opts.help || opts.command != "exec" {
+		t.Errorf("help = %v, command = %q, want help of exec", opts.help, opts.command)
+	}
+}
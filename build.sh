@@ -1,3 +1,6 @@
 #!/bin/bash
 
-CGO_ENABLED=0 GOOS=linux go build -mod=vendor -ldflags "-s -w" -o bin/ctx main.go
+VERSION=$(git describe --tags --always --dirty 2>/dev/null)
+COMMIT=$(git rev-parse --short HEAD 2>/dev/null)
+
+CGO_ENABLED=0 GOOS=linux go build -mod=vendor -ldflags "-s -w -X main.version=${VERSION} -X main.commit=${COMMIT}" -o bin/ctx .
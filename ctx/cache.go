@@ -0,0 +1,99 @@
+package ctx
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// CacheDir returns the directory resolved values are cached in.
+func CacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ctx"), nil
+}
+
+// CacheFile returns the file the cached value of e is stored in. The file is
+// keyed by the type, config directory, ID, source and args of e, by the line,
+// field and delim picking its output and, with context_env, by the variables
+// its environment adds to or changes in the process environment.
+func CacheFile(e *Environment) (string, error) {
+	dir, err := CacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := json.Marshal([]interface{}{
+		e.resolveType(), e.dir, e.ID, e.Source, e.Args,
+		e.Line, e.Field, e.Delim, e.ContextEnv, environDelta(e.environ),
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(key)
+	return filepath.Join(dir, e.resolveType(), hex.EncodeToString(sum[:])), nil
+}
+
+// environDelta returns the entries of environ the process environment does
+// not hold with the same value, sorted.
+func environDelta(environ []string) []string {
+	if environ == nil {
+		return nil
+	}
+
+	process := make(map[string]bool)
+	for _, kv := range os.Environ() {
+		process[kv] = true
+	}
+
+	var delta []string
+	for _, kv := range environ {
+		if !process[kv] {
+			delta = append(delta, kv)
+		}
+	}
+	sort.Strings(delta)
+
+	return delta
+}
+
+// cached serves the value of e from its cache file while that is younger than
+// the cache TTL of e, and otherwise stores the value returned by resolve.
+// Failing to store the value is only a warning.
+func cached(e *Environment, resolve func() (string, error)) (string, error) {
+	ttl, err := time.ParseDuration(*e.Cache)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := CacheFile(e)
+	if err != nil {
+		return "", err
+	}
+
+	if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) < ttl {
+		content, err := os.ReadFile(file)
+		if err == nil {
+			return string(content), nil
+		}
+	}
+
+	content, err := resolve()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		warnf("env %s: can not cache value: %s", e.ID, err)
+	} else if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		warnf("env %s: can not cache value: %s", e.ID, err)
+	}
+
+	return content, nil
+}
@@ -0,0 +1,28 @@
+package ctx
+
+import "testing"
+
+func TestCacheContextEnv(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	contextEnv, ttl, command := true, "1h", "command"
+	newContext := func(id, region string) *Context {
+		return &Context{ID: id, Environments: []*Environment{
+			{ID: "REGION", Source: region},
+			{ID: "OUT", Type: &command, Source: `sh -c 'echo $REGION'`, ContextEnv: &contextEnv, Cache: &ttl},
+		}}
+	}
+
+	for _, c := range []*Context{newContext("a", "eu"), newContext("b", "us"), newContext("a", "eu")} {
+		variables, err := ResolveContext(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := variables[0].Value
+		if out := variables[1].Value; out != want {
+			t.Errorf("context %s: OUT = %q, want %q", c.ID, out, want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package ctx
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Check reports problems in config that otherwise only show once a context is
+// used: env types without a registered resolver, formats Pretty does not
+// know, and IDs defined twice among sibling contexts, the envs of a context or
+// its commands. Attributes the config does not know are already rejected by
+// ParseConfig.
+func Check(config *Config) error {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	duplicates := func(what, where string, ids []string) {
+		seen := make(map[string]bool)
+		for _, id := range ids {
+			if seen[id] {
+				report("%s %s defined twice%s", what, id, where)
+			}
+			seen[id] = true
+		}
+	}
+
+	duplicates("context", "", contextIDs(config.Contexts))
+	err := Walk(config.Contexts, func(path []string, c *Context) error {
+		where := " in context " + JoinPath(path)
+		duplicates("context", where, contextIDs(c.SubContexts))
+
+		var envs []string
+		for _, e := range c.Environments {
+			envs = append(envs, e.ID)
+			if _, ok := resolvers[e.resolveType()]; !ok {
+				report("env %s%s has unknown type %s", e.ID, where, e.resolveType())
+			}
+			if e.Format != nil && *e.Format != "json" {
+				report("env %s%s has unknown format %s, only json is supported", e.ID, where, *e.Format)
+			}
+		}
+		duplicates("env", where, envs)
+
+		var commands []string
+		for _, command := range c.Commands {
+			commands = append(commands, command.ID)
+		}
+		duplicates("command", where, commands)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package ctx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckFormat(t *testing.T) {
+	config := func(format string) *Config {
+		return &Config{Contexts: []*Context{
+			{ID: "a", Environments: []*Environment{{ID: "X", Format: &format}}},
+		}}
+	}
+
+	if err := Check(config("json")); err != nil {
+		t.Errorf("format json: %v", err)
+	}
+
+	for _, format := range []string{"yaml", "jsn", ""} {
+		err := Check(config(format))
+		if err == nil || !strings.Contains(err.Error(), "unknown format") {
+			t.Errorf("format %q: error = %v, want an unknown format", format, err)
+		}
+	}
+}
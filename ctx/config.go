@@ -0,0 +1,476 @@
+// Package ctx loads ctx configuration files and builds the environment of the
+// contexts they define.
+//
+// Reading a config never resolves an environment. Commands that only show
+// the config, such as list and graph, stick to the decoded structs and
+// Context.Metadata. Values are only resolved, running commands and fetching
+// secrets, by ResolveContext and GenerateEnvironment when a context is
+// entered or its environment is asked for.
+package ctx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// Environment is a single variable of a context and how its value is resolved.
+type Environment struct {
+	ID           string         `hcl:",label" json:"id,omitempty"`
+	Type         *string        `hcl:"type" json:"type,omitempty"`
+	Source       string         `hcl:"source,optional" json:"source,omitempty"`
+	Sources      []string       `hcl:"sources,optional" json:"sources,omitempty"`
+	Separator    *string        `hcl:"separator" json:"separator,omitempty"`
+	Args         []string       `hcl:"args,optional" json:"args,omitempty"`
+	Transform    hcl.Expression `hcl:"transform" json:"-"`
+	When         hcl.Expression `hcl:"when" json:"-"`
+	Timeout      *string        `hcl:"timeout" json:"timeout,omitempty"`
+	Retries      *int           `hcl:"retries" json:"retries,omitempty"`
+	RetryDelay   *string        `hcl:"retry_delay" json:"retry_delay,omitempty"`
+	Cache        *string        `hcl:"cache" json:"cache,omitempty"`
+	MaxSize      *int64         `hcl:"max_size" json:"max_size,omitempty"`
+	Encoding     *string        `hcl:"encoding" json:"encoding,omitempty"`
+	NoExpand     *bool          `hcl:"no_expand" json:"no_expand,omitempty"`
+	Line         *int           `hcl:"line" json:"line,omitempty"`
+	Field        *int           `hcl:"field" json:"field,omitempty"`
+	Delim        *string        `hcl:"delim" json:"delim,omitempty"`
+	StreamStderr *bool          `hcl:"stream_stderr" json:"stream_stderr,omitempty"`
+	ContextEnv   *bool          `hcl:"context_env" json:"context_env,omitempty"`
+	Length       *int           `hcl:"length" json:"length,omitempty"`
+	Charset      *string        `hcl:"charset" json:"charset,omitempty"`
+	UTC          *bool          `hcl:"utc" json:"utc,omitempty"`
+	Trim         *bool          `hcl:"trim" json:"trim,omitempty"`
+	Dedent       *bool          `hcl:"dedent" json:"dedent,omitempty"`
+	Validate     *string        `hcl:"validate" json:"validate,omitempty"`
+	MinLength    *int           `hcl:"min_length" json:"min_length,omitempty"`
+	Secret       *bool          `hcl:"secret" json:"secret,omitempty"`
+	Format       *string        `hcl:"format" json:"format,omitempty"`
+
+	dir     string
+	evalCtx *hcl.EvalContext
+
+	// imported is set for the envs ResolveContext makes up for import_env
+	imported bool
+
+	// environ is the environment ResolveContext resolves an env with
+	// context_env in, nil for the process environment
+	environ []string
+}
+
+// IsSecret reports whether the value of e must not be shown. Values of the
+// op, gcp-secret and k8s-secret types are secret unless secret = false is set.
+func (e *Environment) IsSecret() bool {
+	if e.Secret != nil {
+		return *e.Secret
+	}
+
+	switch e.resolveType() {
+	case "op", "gcp-secret", "k8s-secret":
+		return true
+	}
+
+	return false
+}
+
+// Pretty returns value as it is shown to a user, pretty-printed when e sets
+// format = "json", the only format supported; Check rejects any other.
+// Child processes always get the value as resolved. Values that do not parse
+// in their format are returned as they are.
+func (e *Environment) Pretty(value string) string {
+	if e.Format == nil || *e.Format != "json" {
+		return value
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, []byte(value), "", "  "); err != nil {
+		return value
+	}
+
+	return out.String()
+}
+
+// Parts returns e once for every entry of its sources, each with that entry
+// as its source, or just e when it has a single source.
+func (e *Environment) Parts() []*Environment {
+	if len(e.Sources) == 0 {
+		return []*Environment{e}
+	}
+
+	parts := make([]*Environment, len(e.Sources))
+	for i, source := range e.Sources {
+		part := *e
+		part.Source = source
+		part.Sources = nil
+		parts[i] = &part
+	}
+
+	return parts
+}
+
+// separator returns what the values of sources are joined by, the path list
+// separator of the platform by default.
+func (e *Environment) separator() string {
+	if e.Separator != nil {
+		return *e.Separator
+	}
+
+	return string(os.PathListSeparator)
+}
+
+// ConfigDir returns the directory of the config file e is defined in.
+// Relative file sources and the working directory of commands are anchored
+// there.
+func (e *Environment) ConfigDir() string {
+	return e.dir
+}
+
+// Command is a named command line run in the environment of its context.
+type Command struct {
+	ID  string `hcl:",label" json:"id,omitempty"`
+	Run string `hcl:"run" json:"run,omitempty"`
+}
+
+// Context is a named set of environments, optionally nested.
+type Context struct {
+	ID             string         `hcl:",label" json:"id,omitempty"`
+	Description    *string        `hcl:"description" json:"description,omitempty"`
+	Prompt         *string        `hcl:"prompt" json:"prompt,omitempty"`
+	PromptLeft     *string        `hcl:"prompt_left" json:"prompt_left,omitempty"`
+	PromptRight    *string        `hcl:"prompt_right" json:"prompt_right,omitempty"`
+	PromptInherit  *bool          `hcl:"prompt_inherit" json:"prompt_inherit,omitempty"`
+	PromptPrefix   *string        `hcl:"prompt_prefix" json:"prompt_prefix,omitempty"`
+	PromptSuffix   *string        `hcl:"prompt_suffix" json:"prompt_suffix,omitempty"`
+	Extends        *string        `hcl:"extends" json:"extends,omitempty"`
+	EnvPrefix      *string        `hcl:"env_prefix" json:"env_prefix,omitempty"`
+	Hidden         *bool          `hcl:"hidden" json:"hidden,omitempty"`
+	OnExit         *string        `hcl:"on_exit" json:"on_exit,omitempty"`
+	Cwd            *string        `hcl:"cwd" json:"cwd,omitempty"`
+	DefaultCommand *string        `hcl:"default_command" json:"default_command,omitempty"`
+	Watch          *bool          `hcl:"watch" json:"watch,omitempty"`
+	Inherit        *bool          `hcl:"inherit" json:"inherit,omitempty"`
+	ImportEnv      []string       `hcl:"import_env,optional" json:"import_env,omitempty"`
+	Environments   []*Environment `hcl:"env,block" json:"env,omitempty"`
+	Commands       []*Command     `hcl:"command,block" json:"command,omitempty"`
+	SubContexts    []*Context     `hcl:"context,block" json:"context,omitempty"`
+}
+
+// Config is the decoded configuration.
+type Config struct {
+	Shell        *string    `hcl:"shell" json:"shell,omitempty"`
+	ShellArgs    []string   `hcl:"shell_args,optional" json:"shell_args,omitempty"`
+	MaxDepth     *int       `hcl:"max_depth" json:"max_depth,omitempty"`
+	Parallel     *int       `hcl:"parallel" json:"parallel,omitempty"`
+	PromptPrefix *string    `hcl:"prompt_prefix" json:"prompt_prefix,omitempty"`
+	PromptSuffix *string    `hcl:"prompt_suffix" json:"prompt_suffix,omitempty"`
+	Contexts     []*Context `hcl:"context,block" json:"context,omitempty"`
+
+	// Vars holds the strings of all vars blocks, which expressions in the
+	// config reference as vars.<name>.
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+// configFileNames are looked for, in order, when a config file is a
+// directory.
+var configFileNames = []string{"config.hcl", ".ctx.hcl"}
+
+// MainConfigFile returns the file configFile stands for: ~/.ctx.hcl when it
+// is empty, the first of config.hcl and .ctx.hcl inside it when it is a
+// directory, and configFile itself otherwise.
+func MainConfigFile(configFile string) (string, error) {
+	if configFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+
+		return filepath.Join(home, ".ctx.hcl"), nil
+	}
+
+	info, err := os.Stat(configFile)
+	if err != nil || !info.IsDir() {
+		return configFile, nil
+	}
+
+	for _, name := range configFileNames {
+		file := filepath.Join(configFile, name)
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+
+	return "", fmt.Errorf("config directory %s has none of %s", configFile, strings.Join(configFileNames, ", "))
+}
+
+// ConfigFiles returns the files ParseConfig reads for configFile: its
+// MainConfigFile followed by every file in ~/.config/ctx/conf.d, sorted.
+func ConfigFiles(configFile string) ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	explicit := configFile != ""
+	if configFile, err = MainConfigFile(configFile); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	if _, err := os.Stat(configFile); err == nil {
+		files = append(files, configFile)
+	} else if explicit {
+		return nil, err
+	}
+
+	fragments, err := filepath.Glob(filepath.Join(home, ".config", "ctx", "conf.d", "*.hcl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(fragments)
+	files = append(files, fragments...)
+
+	if len(files) == 0 {
+		_, err := os.Stat(configFile)
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// ParseConfig decodes configFile, or ~/.ctx.hcl when it is empty, together
+// with every file in ~/.config/ctx/conf.d into config. A directory stands for
+// the config.hcl or .ctx.hcl inside it.
+func ParseConfig(configFile string, config *Config) error {
+	files, err := ConfigFiles(configFile)
+	if err != nil {
+		return err
+	}
+
+	parser := hclparse.NewParser()
+	bodies := make([]hcl.Body, len(files))
+	varSources := make(map[string]string)
+	config.Vars = make(map[string]string)
+	for i, file := range files {
+		f, diag := parser.ParseHCLFile(file)
+		if diag.HasErrors() {
+			return diag
+		}
+
+		content, remain, diag := f.Body.PartialContent(varsSchema)
+		if diag.HasErrors() {
+			return diag
+		}
+		bodies[i] = remain
+
+		for _, block := range content.Blocks {
+			attrs, diag := block.Body.JustAttributes()
+			if diag.HasErrors() {
+				return diag
+			}
+
+			for name, attr := range attrs {
+				if prev, ok := varSources[name]; ok {
+					return fmt.Errorf("var %s defined in both %s and %s", name, prev, file)
+				}
+
+				val, diag := attr.Expr.Value(nil)
+				if diag.HasErrors() {
+					return diag
+				}
+
+				val, err := convert.Convert(val, cty.String)
+				if err != nil || val.IsNull() {
+					return fmt.Errorf("var %s in %s is not a string", name, file)
+				}
+
+				varSources[name] = file
+				config.Vars[name] = val.AsString()
+			}
+		}
+	}
+
+	evalCtx := evalContext(config.Vars)
+
+	var shellSource, maxDepthSource, parallelSource, prefixSource, suffixSource string
+	sources := make(map[string]string)
+	for i, file := range files {
+		var fragment Config
+		if err := decodeConfigFile(file, bodies[i], evalCtx, &fragment); err != nil {
+			return err
+		}
+
+		if fragment.Shell != nil || len(fragment.ShellArgs) > 0 {
+			if config.Shell != nil || len(config.ShellArgs) > 0 {
+				return fmt.Errorf("shell defined in both %s and %s", shellSource, file)
+			}
+			config.Shell = fragment.Shell
+			config.ShellArgs = fragment.ShellArgs
+			shellSource = file
+		}
+
+		if fragment.MaxDepth != nil {
+			if config.MaxDepth != nil {
+				return fmt.Errorf("max_depth defined in both %s and %s", maxDepthSource, file)
+			}
+			config.MaxDepth = fragment.MaxDepth
+			maxDepthSource = file
+		}
+
+		if fragment.Parallel != nil {
+			if config.Parallel != nil {
+				return fmt.Errorf("parallel defined in both %s and %s", parallelSource, file)
+			}
+			config.Parallel = fragment.Parallel
+			parallelSource = file
+		}
+
+		if fragment.PromptPrefix != nil {
+			if config.PromptPrefix != nil {
+				return fmt.Errorf("prompt_prefix defined in both %s and %s", prefixSource, file)
+			}
+			config.PromptPrefix = fragment.PromptPrefix
+			prefixSource = file
+		}
+
+		if fragment.PromptSuffix != nil {
+			if config.PromptSuffix != nil {
+				return fmt.Errorf("prompt_suffix defined in both %s and %s", suffixSource, file)
+			}
+			config.PromptSuffix = fragment.PromptSuffix
+			suffixSource = file
+		}
+
+		for _, c := range fragment.Contexts {
+			if prev, ok := sources[c.ID]; ok {
+				return fmt.Errorf("context %s defined in both %s and %s", c.ID, prev, file)
+			}
+			sources[c.ID] = file
+			config.Contexts = append(config.Contexts, c)
+		}
+	}
+
+	return resolveExtends(config)
+}
+
+var varsSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{{Type: "vars"}},
+}
+
+// evalContext exposes vars to expressions in the config as vars.<name>.
+func evalContext(vars map[string]string) *hcl.EvalContext {
+	values := make(map[string]cty.Value, len(vars))
+	for name, value := range vars {
+		values[name] = cty.StringVal(value)
+	}
+
+	return &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"vars": cty.ObjectVal(values),
+		},
+	}
+}
+
+// resolveExtends merges the environments of every extended context into the
+// contexts extending it. Environments defined by the extending context take
+// precedence over those of its base, and a missing prompt is inherited.
+func resolveExtends(config *Config) error {
+	resolved := make(map[*Context]bool)
+	resolving := make(map[*Context]bool)
+
+	var resolve func(path string, c *Context) error
+	resolve = func(path string, c *Context) error {
+		if c.Extends == nil || resolved[c] {
+			return nil
+		}
+
+		if resolving[c] {
+			return fmt.Errorf("circular extends through context %s", path)
+		}
+
+		base := Lookup(config, *c.Extends)
+		if base == nil {
+			return fmt.Errorf("context %s extends unknown context %s", path, *c.Extends)
+		}
+
+		resolving[c] = true
+		if err := resolve(*c.Extends, base); err != nil {
+			return err
+		}
+		delete(resolving, c)
+		resolved[c] = true
+
+		defined := make(map[string]bool)
+		for _, e := range c.Environments {
+			defined[e.ID] = true
+		}
+
+		var envs []*Environment
+		for _, e := range base.Environments {
+			if !defined[e.ID] {
+				envs = append(envs, e)
+			}
+		}
+		c.Environments = append(envs, c.Environments...)
+
+		if c.Prompt == nil {
+			c.Prompt = base.Prompt
+		}
+		if c.PromptLeft == nil {
+			c.PromptLeft = base.PromptLeft
+		}
+		if c.PromptRight == nil {
+			c.PromptRight = base.PromptRight
+		}
+		if c.PromptPrefix == nil {
+			c.PromptPrefix = base.PromptPrefix
+		}
+		if c.PromptSuffix == nil {
+			c.PromptSuffix = base.PromptSuffix
+		}
+		if c.Cwd == nil {
+			c.Cwd = base.Cwd
+		}
+		if c.DefaultCommand == nil {
+			c.DefaultCommand = base.DefaultCommand
+		}
+		if c.ImportEnv == nil {
+			c.ImportEnv = base.ImportEnv
+		}
+
+		return nil
+	}
+
+	return Walk(config.Contexts, func(path []string, c *Context) error {
+		return resolve(JoinPath(path), c)
+	})
+}
+
+func decodeConfigFile(configFile string, body hcl.Body, evalCtx *hcl.EvalContext, config *Config) error {
+	diag := gohcl.DecodeBody(body, evalCtx, config)
+	if diag.HasErrors() {
+		return diag
+	}
+
+	abs, err := filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(abs)
+	return Walk(config.Contexts, func(path []string, c *Context) error {
+		for _, e := range c.Environments {
+			e.dir = dir
+			e.evalCtx = evalCtx
+		}
+		return nil
+	})
+}
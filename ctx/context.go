@@ -0,0 +1,214 @@
+package ctx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// SplitPath splits a comma separated context path into IDs. A backslash makes
+// the following character, including a comma or another backslash, part of
+// the ID.
+func SplitPath(path string) []string {
+	var parts []string
+	var id strings.Builder
+	escaped := false
+
+	for _, r := range path {
+		switch {
+		case escaped:
+			id.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			parts = append(parts, id.String())
+			id.Reset()
+		default:
+			id.WriteRune(r)
+		}
+	}
+
+	return append(parts, id.String())
+}
+
+// JoinPath is the inverse of SplitPath, escaping commas and backslashes in
+// the IDs.
+func JoinPath(ids []string) string {
+	escaped := make([]string, len(ids))
+	for i, id := range ids {
+		escaped[i] = pathEscaper.Replace(id)
+	}
+	return strings.Join(escaped, ",")
+}
+
+var pathEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`)
+
+// Lookup returns the context at the comma separated path, or nil.
+func Lookup(cfg *Config, path string) *Context {
+	contexts, err := FindPath(cfg, path)
+	if err != nil {
+		return nil
+	}
+
+	return contexts[len(contexts)-1]
+}
+
+// FindPath returns the contexts along the comma separated path, starting with
+// a top level context and ending with the one path addresses. Surrounding
+// whitespace of every ID is ignored, and so are empty segments. The error
+// names the first ID that could not be found.
+func FindPath(cfg *Config, path string) ([]*Context, error) {
+	return findPath(cfg, path, false)
+}
+
+// FindPrefix is FindPath, also accepting an ID that is not found for the
+// context whose ID it is a unique prefix of. An exact match always wins, and
+// a prefix of several IDs is an error naming them.
+func FindPrefix(cfg *Config, path string) ([]*Context, error) {
+	return findPath(cfg, path, true)
+}
+
+func findPath(cfg *Config, path string, prefix bool) ([]*Context, error) {
+	var contexts []*Context
+	var found []string
+	parent := cfg.Contexts
+
+	for _, p := range SplitPath(path) {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		var current *Context
+		for _, c := range parent {
+			if p == c.ID {
+				current = c
+				break
+			}
+		}
+
+		if current == nil && prefix {
+			var candidates []string
+			for _, c := range parent {
+				if strings.HasPrefix(c.ID, p) {
+					current = c
+					candidates = append(candidates, c.ID)
+				}
+			}
+
+			if len(candidates) > 1 {
+				return nil, fmt.Errorf("context %s is ambiguous, it could be %s", p, strings.Join(candidates, ", "))
+			}
+		}
+
+		if current == nil {
+			if len(found) == 0 {
+				return nil, fmt.Errorf("context %s not found", p)
+			}
+			return nil, fmt.Errorf("context %s not found in %s", p, JoinPath(found))
+		}
+
+		contexts = append(contexts, current)
+		found = append(found, p)
+		parent = current.SubContexts
+	}
+
+	if len(contexts) == 0 {
+		return nil, errors.New("empty context path")
+	}
+
+	return contexts, nil
+}
+
+// ContextPath returns the path of contexts as returned by FindPath.
+func ContextPath(contexts []*Context) string {
+	ids := make([]string, len(contexts))
+	for i, c := range contexts {
+		ids[i] = c.ID
+	}
+	return JoinPath(ids)
+}
+
+// IsHidden reports whether c is left out of listings.
+func (c *Context) IsHidden() bool {
+	return c.Hidden != nil && *c.Hidden
+}
+
+// EnvironmentNames returns the names of the variables c adds to the
+// environment, with its env_prefix applied.
+func (c *Context) EnvironmentNames() []string {
+	var prefix string
+	if c.EnvPrefix != nil {
+		prefix = *c.EnvPrefix
+	}
+
+	names := make([]string, len(c.Environments))
+	for i, e := range c.Environments {
+		names[i] = prefix + e.ID
+	}
+	return names
+}
+
+// SkipContext can be returned by the function passed to Walk to skip the
+// subcontexts of the context it was called with.
+var SkipContext = errors.New("skip this context")
+
+// Walk visits every context in the tree below contexts depth-first, calling
+// fn with the path of each context relative to contexts. A context that is
+// reached again from within its own subtree is reported as an error rather
+// than followed.
+func Walk(contexts []*Context, fn func(path []string, c *Context) error) error {
+	return walkPath(contexts, nil, make(map[*Context]bool), fn)
+}
+
+func walkPath(contexts []*Context, path []string, visiting map[*Context]bool, fn func(path []string, c *Context) error) error {
+	for _, c := range contexts {
+		current := append(path[:len(path):len(path)], c.ID)
+		if visiting[c] {
+			return fmt.Errorf("circular context reference: %s", JoinPath(current))
+		}
+
+		if err := fn(current, c); err == SkipContext {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		visiting[c] = true
+		err := walkPath(c.SubContexts, current, visiting, fn)
+		delete(visiting, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ChangedFiles returns the files read by the file and dotenv envs of c that
+// were modified after since, or that are gone. It is empty unless c sets
+// watch.
+func (c *Context) ChangedFiles(since time.Time) []string {
+	if c.Watch == nil || !*c.Watch {
+		return nil
+	}
+
+	var changed []string
+	for _, e := range c.Environments {
+		if typ := e.resolveType(); typ != "file" && typ != "dotenv" {
+			continue
+		}
+
+		for _, part := range e.Parts() {
+			info, err := os.Stat(part.SourcePath())
+			if err != nil || info.ModTime().After(since) {
+				changed = append(changed, part.SourcePath())
+			}
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,121 @@
+package ctx
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	tests := []struct {
+		path string
+		ids  []string
+	}{
+		{"a", []string{"a"}},
+		{"a,b", []string{"a", "b"}},
+		{"a,,b", []string{"a", "", "b"}},
+		{",a", []string{"", "a"}},
+		{"a,", []string{"a", ""}},
+		{",", []string{"", ""}},
+		{"", []string{""}},
+		{`release\,1.2,web`, []string{"release,1.2", "web"}},
+		{`a\\,b`, []string{`a\`, "b"}},
+		{`a\`, []string{"a"}},
+	}
+
+	for _, test := range tests {
+		if ids := SplitPath(test.path); !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("SplitPath(%q) = %q, want %q", test.path, ids, test.ids)
+		}
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	for _, ids := range [][]string{
+		{"a", "b"},
+		{"release,1.2", "web"},
+		{`a\`, "b"},
+		{"", "a"},
+	} {
+		if split := SplitPath(JoinPath(ids)); !reflect.DeepEqual(split, ids) {
+			t.Errorf("SplitPath(JoinPath(%q)) = %q", ids, split)
+		}
+	}
+}
+
+func TestFindPath(t *testing.T) {
+	config := &Config{Contexts: []*Context{
+		{ID: "a", SubContexts: []*Context{{ID: "b"}, {ID: "bc"}}},
+		{ID: "x,y"},
+	}}
+
+	tests := []struct {
+		path string
+		want string
+		err  string
+	}{
+		{path: "a,b", want: "a,b"},
+		{path: "a,,b", want: "a,b"},
+		{path: ",a,b", want: "a,b"},
+		{path: "a,b,", want: "a,b"},
+		{path: " a , b ", want: "a,b"},
+		{path: `x\,y`, want: `x\,y`},
+		{path: "", err: "empty context path"},
+		{path: ",,", err: "empty context path"},
+		{path: "b", err: "context b not found"},
+		{path: "a,c", err: "context c not found in a"},
+	}
+
+	for _, test := range tests {
+		contexts, err := FindPath(config, test.path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("FindPath(%q) error = %v, want %q", test.path, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("FindPath(%q): %v", test.path, err)
+			continue
+		}
+
+		if path := ContextPath(contexts); path != test.want {
+			t.Errorf("FindPath(%q) = %q, want %q", test.path, path, test.want)
+		}
+	}
+}
+
+func TestFindPrefix(t *testing.T) {
+	config := &Config{Contexts: []*Context{
+		{ID: "a", SubContexts: []*Context{{ID: "b"}, {ID: "bc"}, {ID: "de"}, {ID: "df"}}},
+	}}
+
+	tests := []struct {
+		path string
+		want string
+		err  string
+	}{
+		{path: "a,b", want: "a,b"},
+		{path: "a,bc", want: "a,bc"},
+		{path: "a,,de", want: "a,de"},
+		{path: "a,d", err: "context d is ambiguous, it could be de, df"},
+	}
+
+	for _, test := range tests {
+		contexts, err := FindPrefix(config, test.path)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("FindPrefix(%q) error = %v, want %q", test.path, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("FindPrefix(%q): %v", test.path, err)
+			continue
+		}
+
+		if path := ContextPath(contexts); path != test.want {
+			t.Errorf("FindPrefix(%q) = %q, want %q", test.path, path, test.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package ctx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ParseDotenv reads KEY=VALUE lines in the format of .env files from r. Blank
+// lines and lines starting with # are skipped, an export prefix is allowed
+// and a value may be wrapped in single or double quotes.
+func ParseDotenv(r io.Reader) ([]string, error) {
+	return parseDotenv(r, false)
+}
+
+// parseDotenv is ParseDotenv, expanding ${VAR} and $VAR in values that are
+// not single quoted when expand is set, like docker compose does. Keys
+// defined on earlier lines take precedence over the environment of ctx.
+func parseDotenv(r io.Reader, expand bool) ([]string, error) {
+	var envs []string
+	defined := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("line %d is not in KEY=VALUE form", n)
+		}
+
+		value = strings.TrimSpace(value)
+		quote := byte(0)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			quote = value[0]
+			value = value[1 : len(value)-1]
+		}
+
+		if expand && quote != '\'' {
+			value = os.Expand(value, func(key string) string {
+				if v, ok := defined[key]; ok {
+					return v
+				}
+				return os.Getenv(key)
+			})
+		}
+
+		defined[name] = value
+		envs = append(envs, name+"="+value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return envs, nil
+}
+
+// resolveDotenv returns the value the .env file at the source of e gives the
+// key named like e. The file is read like a file env, so max_size and
+// encoding apply, and values are expanded unless no_expand is set.
+func resolveDotenv(e *Environment) (string, error) {
+	content, err := resolveFile(e)
+	if err != nil {
+		return "", err
+	}
+
+	expand := e.NoExpand == nil || !*e.NoExpand
+	envs, err := parseDotenv(strings.NewReader(content), expand)
+	if err != nil {
+		return "", fmt.Errorf("dotenv %s: %w", e.SourcePath(), err)
+	}
+
+	value, found := "", false
+	for _, env := range envs {
+		if name, v, _ := strings.Cut(env, "="); name == e.ID {
+			value, found = v, true
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("dotenv %s has no key %s", e.SourcePath(), e.ID)
+	}
+
+	return value, nil
+}
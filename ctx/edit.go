@@ -0,0 +1,305 @@
+package ctx
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// RenameContext changes the ID of the context at the full path to id and
+// rewrites every extends that goes through it. The config files of
+// configFile are edited in place, keeping their formatting, and only once
+// all of them could be edited.
+func RenameContext(configFile, path, id string) error {
+	if strings.TrimSpace(id) == "" {
+		return fmt.Errorf("empty context ID")
+	}
+
+	var config Config
+	if err := ParseConfig(configFile, &config); err != nil {
+		return err
+	}
+
+	contexts, err := FindPath(&config, path)
+	if err != nil {
+		return err
+	}
+
+	ids := contextIDs(contexts)
+
+	siblings := config.Contexts
+	if len(contexts) > 1 {
+		siblings = contexts[len(contexts)-2].SubContexts
+	}
+	for _, c := range siblings {
+		if c.ID == id && c != contexts[len(contexts)-1] {
+			return fmt.Errorf("context %s already exists", JoinPath(append(ids[:len(ids)-1:len(ids)-1], id)))
+		}
+	}
+
+	files, err := ConfigFiles(configFile)
+	if err != nil {
+		return err
+	}
+
+	edited := make(map[string]*hclwrite.File)
+	renamed := false
+	for _, file := range files {
+		f, err := parseWritable(file)
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		if block := findContextBlock(f.Body(), ids); block != nil {
+			block.SetLabels([]string{id})
+			changed, renamed = true, true
+		}
+
+		if rewriteExtends(f.Body(), ids, id) {
+			changed = true
+		}
+
+		if changed {
+			edited[file] = f
+		}
+	}
+
+	if !renamed {
+		return fmt.Errorf("context %s is not defined in any config file", path)
+	}
+
+	return writeFiles(edited)
+}
+
+// parseWritable parses file for editing with hclwrite.
+func parseWritable(file string) (*hclwrite.File, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	f, diag := hclwrite.ParseConfig(src, file, hcl.InitialPos)
+	if diag.HasErrors() {
+		return nil, diag
+	}
+
+	return f, nil
+}
+
+// writeFiles writes every edited file back, keeping its permissions.
+func writeFiles(edited map[string]*hclwrite.File) error {
+	for file, f := range edited {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(file, f.Bytes(), info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findContextBlock returns the context block at ids below body, or nil when
+// body does not define it.
+func findContextBlock(body *hclwrite.Body, ids []string) *hclwrite.Block {
+	for _, block := range body.Blocks() {
+		if block.Type() != "context" || len(block.Labels()) != 1 || block.Labels()[0] != ids[0] {
+			continue
+		}
+
+		if len(ids) == 1 {
+			return block
+		}
+
+		if found := findContextBlock(block.Body(), ids[1:]); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+// rewriteExtends replaces the last of ids with id in every extends below body
+// that goes through the context at ids. Extends which are not plain strings
+// are left alone. It reports whether anything changed.
+func rewriteExtends(body *hclwrite.Body, ids []string, id string) bool {
+	changed := false
+	for _, block := range body.Blocks() {
+		if block.Type() != "context" {
+			continue
+		}
+
+		if rewriteExtends(block.Body(), ids, id) {
+			changed = true
+		}
+
+		extends, ok := stringAttribute(block.Body(), "extends")
+		if !ok {
+			continue
+		}
+
+		path := SplitPath(extends)
+		if len(path) < len(ids) {
+			continue
+		}
+
+		matches := true
+		for i := range ids {
+			if strings.TrimSpace(path[i]) != ids[i] {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			path[len(ids)-1] = id
+			block.Body().SetAttributeValue("extends", cty.StringVal(JoinPath(path)))
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// stringAttribute returns the value of the attribute name of body when it is
+// a constant string.
+func stringAttribute(body *hclwrite.Body, name string) (string, bool) {
+	attr := body.GetAttribute(name)
+	if attr == nil {
+		return "", false
+	}
+
+	expr, diag := hclsyntax.ParseExpression(attr.Expr().BuildTokens(nil).Bytes(), name, hcl.InitialPos)
+	if diag.HasErrors() {
+		return "", false
+	}
+
+	val, diag := expr.Value(nil)
+	if diag.HasErrors() || val.IsNull() || val.Type() != cty.String {
+		return "", false
+	}
+
+	return val.AsString(), true
+}
+
+// AddContext appends an empty context at the full path, whose last ID is the
+// new one, to the config files of configFile. A top-level context goes into
+// the first file, any other into the file defining its parent.
+func AddContext(configFile, path string) error {
+	ids := SplitPath(path)
+	if len(ids) == 0 || strings.TrimSpace(ids[len(ids)-1]) == "" {
+		return fmt.Errorf("empty context ID")
+	}
+	id := strings.TrimSpace(ids[len(ids)-1])
+
+	var config Config
+	if err := ParseConfig(configFile, &config); err != nil {
+		return err
+	}
+
+	siblings := config.Contexts
+	if len(ids) > 1 {
+		parents, err := FindPath(&config, JoinPath(ids[:len(ids)-1]))
+		if err != nil {
+			return err
+		}
+		ids = append(contextIDs(parents), id)
+		siblings = parents[len(parents)-1].SubContexts
+	}
+	for _, c := range siblings {
+		if c.ID == id {
+			return fmt.Errorf("context %s already exists", JoinPath(ids))
+		}
+	}
+
+	return editBlock(configFile, ids[:len(ids)-1], func(body *hclwrite.Body) error {
+		body.AppendNewline()
+		body.AppendNewBlock("context", []string{id})
+		return nil
+	})
+}
+
+// AddEnvironment appends an env id to the context at the full path, with the
+// given type and source. An empty type is left out, making it static.
+func AddEnvironment(configFile, path, id, typ, source string) error {
+	if strings.TrimSpace(id) == "" {
+		return fmt.Errorf("empty env ID")
+	}
+
+	var config Config
+	if err := ParseConfig(configFile, &config); err != nil {
+		return err
+	}
+
+	contexts, err := FindPath(&config, path)
+	if err != nil {
+		return err
+	}
+	ids := contextIDs(contexts)
+
+	return editBlock(configFile, ids, func(body *hclwrite.Body) error {
+		for _, block := range body.Blocks() {
+			if block.Type() == "env" && len(block.Labels()) == 1 && block.Labels()[0] == id {
+				return fmt.Errorf("context %s already has env %s", JoinPath(ids), id)
+			}
+		}
+
+		env := body.AppendNewBlock("env", []string{id}).Body()
+		if typ != "" {
+			env.SetAttributeValue("type", cty.StringVal(typ))
+		}
+		env.SetAttributeValue("source", cty.StringVal(source))
+		return nil
+	})
+}
+
+// editBlock applies edit to the body of the context block at ids, or to the
+// top level of the first file when ids is empty, and writes the file back
+// unless edit fails.
+func editBlock(configFile string, ids []string, edit func(body *hclwrite.Body) error) error {
+	files, err := ConfigFiles(configFile)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		f, err := parseWritable(file)
+		if err != nil {
+			return err
+		}
+
+		body := f.Body()
+		if len(ids) > 0 {
+			block := findContextBlock(body, ids)
+			if block == nil {
+				continue
+			}
+			body = block.Body()
+		}
+
+		if err := edit(body); err != nil {
+			return err
+		}
+		return writeFiles(map[string]*hclwrite.File{file: f})
+	}
+
+	return fmt.Errorf("context %s is not defined in any config file", JoinPath(ids))
+}
+
+func contextIDs(contexts []*Context) []string {
+	ids := make([]string, len(contexts))
+	for i, c := range contexts {
+		ids[i] = c.ID
+	}
+
+	return ids
+}
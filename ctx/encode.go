@@ -0,0 +1,138 @@
+package ctx
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// EncodeConfig returns config as a single HCL file, as ParseConfig left it:
+// all config files merged and extends applied, so extends itself is left
+// out. transform and when are copied from the config files as written.
+func EncodeConfig(config *Config) ([]byte, error) {
+	f := hclwrite.NewEmptyFile()
+	body := f.Body()
+	gohcl.EncodeIntoBody(config, body)
+	removeUnset(body)
+
+	if len(config.Vars) > 0 {
+		names := make([]string, 0, len(config.Vars))
+		for name := range config.Vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		body.AppendNewline()
+		vars := body.AppendNewBlock("vars", nil).Body()
+		for _, name := range names {
+			vars.SetAttributeValue(name, cty.StringVal(config.Vars[name]))
+		}
+	}
+
+	sources := make(map[string][]byte)
+	if err := encodeExpressions(body, config.Contexts, sources); err != nil {
+		return nil, err
+	}
+
+	// gohcl puts a blank line before the first block of a body, even one
+	// without attributes, and none between top level blocks
+	out := bytes.ReplaceAll(f.Bytes(), []byte("{\n\n"), []byte("{\n"))
+	out = topLevelEnd.ReplaceAll(out, []byte("}\n\n$1"))
+	return hclwrite.Format(out), nil
+}
+
+var topLevelEnd = regexp.MustCompile(`(?m)^}\n(\S)`)
+
+// encodeExpressions adds the expressions gohcl can not encode to the context
+// blocks of body, which hold contexts in order.
+func encodeExpressions(body *hclwrite.Body, contexts []*Context, sources map[string][]byte) error {
+	blocks := blocksOfType(body, "context")
+	for i, c := range contexts {
+		if i >= len(blocks) {
+			break
+		}
+
+		envs := blocksOfType(blocks[i].Body(), "env")
+		for j, e := range c.Environments {
+			if j >= len(envs) {
+				break
+			}
+
+			for _, attribute := range []struct {
+				name string
+				expr hcl.Expression
+			}{{"transform", e.Transform}, {"when", e.When}} {
+				src, err := expressionSource(attribute.expr, sources)
+				if err != nil {
+					return err
+				}
+				if src != nil {
+					envs[j].Body().SetAttributeRaw(attribute.name, hclwrite.Tokens{
+						{Type: hclsyntax.TokenIdent, Bytes: src},
+					})
+				}
+			}
+		}
+
+		if err := encodeExpressions(blocks[i].Body(), c.SubContexts, sources); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expressionSource returns the text of expr in the config file defining it,
+// or nil when the attribute was not set.
+func expressionSource(expr hcl.Expression, sources map[string][]byte) ([]byte, error) {
+	if expr == nil {
+		return nil, nil
+	}
+	if val, diag := expr.Value(nil); !diag.HasErrors() && val.IsNull() {
+		return nil, nil
+	}
+
+	rng := expr.Range()
+	src, ok := sources[rng.Filename]
+	if !ok {
+		var err error
+		if src, err = os.ReadFile(rng.Filename); err != nil {
+			return nil, err
+		}
+		sources[rng.Filename] = src
+	}
+
+	return rng.SliceBytes(src), nil
+}
+
+// removeUnset removes the attributes gohcl encodes as null for empty lists,
+// and extends, from body and its blocks.
+func removeUnset(body *hclwrite.Body) {
+	for name, attribute := range body.Attributes() {
+		if name == "extends" || strings.TrimSpace(string(attribute.Expr().BuildTokens(nil).Bytes())) == "null" {
+			body.RemoveAttribute(name)
+		}
+	}
+
+	for _, block := range body.Blocks() {
+		removeUnset(block.Body())
+	}
+}
+
+func blocksOfType(body *hclwrite.Body, typ string) []*hclwrite.Block {
+	var blocks []*hclwrite.Block
+	for _, block := range body.Blocks() {
+		if block.Type() == typ {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
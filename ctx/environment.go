@@ -0,0 +1,645 @@
+package ctx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+const defaultRetryDelay = 500 * time.Millisecond
+
+// Warnings receives non-fatal problems found while resolving environments,
+// one per line. It is os.Stderr by default; set it to io.Discard to silence
+// them.
+var Warnings io.Writer = os.Stderr
+
+// Parallel bounds how many environments of a context ResolveContext resolves
+// at once. It is the number of CPUs by default.
+var Parallel = runtime.NumCPU()
+
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(Warnings, "warning: "+format+"\n", args...)
+}
+
+const (
+	// ActiveEnv is the environment variable holding the comma separated
+	// path of the active context.
+	ActiveEnv = "CTX_ACTIVE"
+
+	// DepthEnv is the environment variable holding the number of IDs in
+	// the path of the active context.
+	DepthEnv = "CTX_DEPTH"
+
+	// ActiveIDEnv is the environment variable holding the ID of the active
+	// context, the last ID of its path.
+	ActiveIDEnv = "CTX_ACTIVE_ID"
+
+	// ManagedEnv is the environment variable holding the comma separated
+	// names of the variables the active context added.
+	ManagedEnv = "CTX_MANAGED_VARS"
+
+	// EnteredEnv is the environment variable holding the Unix time in
+	// nanoseconds at which the shell of the active context was started.
+	EnteredEnv = "CTX_ENTERED"
+)
+
+// Variable is a resolved environment of a context, named as the variable it
+// is exported as.
+type Variable struct {
+	Name        string
+	Value       string
+	Environment *Environment
+}
+
+// ResolveContext resolves, transforms and validates the environments of
+// context, up to Parallel of them at once. Only the variables context defines
+// are returned, in order, with its env_prefix applied, after the variables of
+// import_env with the values they have in the process environment. An env
+// whose when expression reads env.<NAME>, or that sets context_env to run in
+// the variables resolved so far, waits for every env before it. Commands run
+// one at a time, with stdin, while the other types resolve concurrently.
+func ResolveContext(context *Context) ([]Variable, error) {
+	return resolveContext(context, environMap(os.Environ()))
+}
+
+// resolveContext is ResolveContext, reading env.<NAME> and import_env from env
+// instead of the process environment. The variables context defines are added
+// to env as they are resolved.
+func resolveContext(context *Context, env map[string]string) ([]Variable, error) {
+	var prefix string
+	if context.EnvPrefix != nil {
+		prefix = *context.EnvPrefix
+	}
+
+	var variables []Variable
+	for _, name := range context.ImportEnv {
+		value, ok := env[name]
+		if !ok {
+			warnf("context %s imports %s, which is not set", context.ID, name)
+			continue
+		}
+
+		e := &Environment{ID: name, Source: value, imported: true}
+		variables = append(variables, Variable{Name: name, Value: value, Environment: e})
+	}
+
+	var pending []*Environment
+	flush := func() error {
+		values := make([]string, len(pending))
+		errs := make([]error, len(pending))
+
+		limit := Parallel
+		if limit < 1 {
+			limit = 1
+		}
+		slots := make(chan struct{}, limit)
+
+		var wg sync.WaitGroup
+		for i, e := range pending {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(i int, e *Environment) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				values[i], errs[i] = resolveVariable(e)
+			}(i, e)
+		}
+		wg.Wait()
+
+		for i, e := range pending {
+			if errs[i] != nil {
+				return resolveError(context, e, errs[i])
+			}
+			variables = append(variables, Variable{Name: prefix + e.ID, Value: values[i], Environment: e})
+			env[prefix+e.ID] = values[i]
+		}
+
+		pending = nil
+		return nil
+	}
+
+	for _, e := range context.Environments {
+		contextEnv := e.ContextEnv != nil && *e.ContextEnv
+		if readsEnv(e.When) || contextEnv {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+
+		if ok, err := evaluateWhen(e, env); err != nil {
+			return nil, resolveError(context, e, err)
+		} else if !ok {
+			continue
+		}
+
+		if contextEnv {
+			resolving := *e
+			resolving.environ = make([]string, 0, len(env))
+			for name, value := range env {
+				resolving.environ = append(resolving.environ, name+"="+value)
+			}
+			e = &resolving
+		}
+		pending = append(pending, e)
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return variables, nil
+}
+
+// resolveVariable resolves, transforms and validates the value of e.
+func resolveVariable(e *Environment) (string, error) {
+	val, err := ResolveEnvironment(e)
+	if err != nil {
+		return "", err
+	}
+
+	val, err = transformEnvironment(e, val)
+	if err != nil {
+		return "", err
+	}
+
+	if err := validateEnvironment(e, val); err != nil {
+		return "", err
+	}
+
+	return val, nil
+}
+
+// readsEnv reports whether expr references env.<NAME>.
+func readsEnv(expr hcl.Expression) bool {
+	if expr == nil {
+		return false
+	}
+
+	for _, traversal := range expr.Variables() {
+		if traversal.RootName() == "env" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GenerateEnvironment returns the process environment, or nothing when the
+// context at path sets inherit = false, extended with the resolved
+// environments of every context on path, ManagedEnv, additionalEnvs,
+// ActiveEnv set to path, the full comma separated path of the context,
+// DepthEnv and ActiveIDEnv.
+//
+// A path below the active context only resolves the contexts below it, the
+// process environment already holds the variables of the others when ctx
+// started it, which ManagedEnv being set tells. Any other path, and every
+// path with inherit = false, first drops the variables ManagedEnv lists and
+// then resolves all contexts on path, from the top.
+func GenerateEnvironment(config *Config, path string, additionalEnvs []string) ([]string, error) {
+	contexts, err := FindPath(config, path)
+	if err != nil {
+		return nil, err
+	}
+	context := contexts[len(contexts)-1]
+	inherit := context.Inherit == nil || *context.Inherit
+
+	environ := os.Environ()
+	managed, _ := ManagedNames()
+	resolve := contexts
+	if depth, ok := activeDepth(contexts); ok && inherit {
+		resolve = contexts[depth:]
+	} else {
+		environ = withoutNames(environ, managed)
+		managed = nil
+	}
+
+	env := environMap(environ)
+	var variables []Variable
+	for _, c := range resolve {
+		resolved, err := resolveContext(c, env)
+		if err != nil {
+			return nil, err
+		}
+		variables = append(variables, resolved...)
+	}
+
+	var environmentVariables []string
+	if inherit {
+		environmentVariables = append(environmentVariables, environ...)
+	}
+	for _, v := range variables {
+		environmentVariables = append(environmentVariables, fmt.Sprintf("%s=%s", v.Name, v.Value))
+	}
+	environmentVariables = append(environmentVariables, managedEnvironment(managed, variables))
+	environmentVariables = append(environmentVariables, additionalEnvs...)
+	environmentVariables = append(environmentVariables, ActiveEnvironment(ContextPath(contexts))...)
+
+	return environmentVariables, nil
+}
+
+// MergeEnvironment returns the process environment, without the variables
+// ManagedEnv lists, extended with the resolved environments of every context
+// on each of paths in turn, so later contexts override earlier ones. ManagedEnv
+// lists them all, and ActiveEnv, DepthEnv and ActiveIDEnv are set for the
+// last path.
+func MergeEnvironment(config *Config, paths []string) ([]string, error) {
+	managed, _ := ManagedNames()
+	environ := withoutNames(os.Environ(), managed)
+	env := environMap(environ)
+
+	var variables []Variable
+	var path string
+	for _, p := range paths {
+		contexts, err := FindPath(config, p)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range contexts {
+			resolved, err := resolveContext(c, env)
+			if err != nil {
+				return nil, err
+			}
+			variables = append(variables, resolved...)
+		}
+		path = ContextPath(contexts)
+	}
+
+	environmentVariables := environ
+	for _, v := range variables {
+		environmentVariables = append(environmentVariables, fmt.Sprintf("%s=%s", v.Name, v.Value))
+	}
+	environmentVariables = append(environmentVariables, ManagedEnvironment(variables))
+	environmentVariables = append(environmentVariables, ActiveEnvironment(path)...)
+
+	return environmentVariables, nil
+}
+
+// activeDepth returns the number of contexts in the path of the active
+// context, when contexts lies below it and ctx set up the process
+// environment for the active context.
+func activeDepth(contexts []*Context) (int, bool) {
+	active := os.Getenv(ActiveEnv)
+	if active == "" {
+		return 0, true
+	}
+
+	if _, ok := os.LookupEnv(ManagedEnv); !ok {
+		return 0, false
+	}
+
+	ids := SplitPath(active)
+	if len(ids) >= len(contexts) {
+		return 0, false
+	}
+	for i, id := range ids {
+		if contexts[i].ID != id {
+			return 0, false
+		}
+	}
+
+	return len(ids), true
+}
+
+// environMap returns the variables of environ by name.
+func environMap(environ []string) map[string]string {
+	env := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if name, value, ok := strings.Cut(kv, "="); ok {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+// withoutNames returns environ without the variables called names.
+func withoutNames(environ, names []string) []string {
+	if len(names) == 0 {
+		return environ
+	}
+
+	drop := make(map[string]bool, len(names))
+	for _, name := range names {
+		drop[name] = true
+	}
+
+	var kept []string
+	for _, kv := range environ {
+		if name, _, _ := strings.Cut(kv, "="); !drop[name] {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
+
+// ManagedEnvironment returns ManagedEnv listing the names of variables, so
+// they can be removed precisely when the context is left. Variables of
+// import_env were there before and are not listed.
+func ManagedEnvironment(variables []Variable) string {
+	return managedEnvironment(nil, variables)
+}
+
+// managedEnvironment is ManagedEnvironment, listing the names of variables
+// after names.
+func managedEnvironment(names []string, variables []Variable) string {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		seen[name] = true
+	}
+	for _, v := range variables {
+		if v.Environment != nil && v.Environment.imported {
+			continue
+		}
+
+		if !seen[v.Name] {
+			seen[v.Name] = true
+			names = append(names, v.Name)
+		}
+	}
+
+	return ManagedEnv + "=" + strings.Join(names, ",")
+}
+
+// ManagedNames returns the names ManagedEnv lists in the process
+// environment, and whether it is set.
+func ManagedNames() ([]string, bool) {
+	managed, ok := os.LookupEnv(ManagedEnv)
+	if !ok {
+		return nil, false
+	}
+
+	var names []string
+	for _, name := range strings.Split(managed, ",") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names, true
+}
+
+// ActiveEnvironment returns ActiveEnv, DepthEnv and ActiveIDEnv for the
+// context at the full path.
+func ActiveEnvironment(path string) []string {
+	ids := SplitPath(path)
+	envs := []string{
+		fmt.Sprintf("%s=%s", ActiveEnv, path),
+		fmt.Sprintf("%s=%d", DepthEnv, len(ids)),
+	}
+	if len(ids) > 0 {
+		envs = append(envs, fmt.Sprintf("%s=%s", ActiveIDEnv, ids[len(ids)-1]))
+	}
+
+	return envs
+}
+
+// ResolveEnvironment returns the value of e using the resolver registered for
+// its type, which defaults to static. With sources, every source is resolved
+// and the values are joined by the separator. Values are only cached when e
+// sets a cache TTL.
+func ResolveEnvironment(e *Environment) (string, error) {
+	if len(e.Sources) > 0 {
+		if e.Source != "" {
+			return "", errors.New("source and sources are both set")
+		}
+
+		parts := e.Parts()
+		values := make([]string, len(parts))
+		for i, part := range parts {
+			value, err := ResolveEnvironment(part)
+			if err != nil {
+				return "", fmt.Errorf("source %d: %w", i+1, err)
+			}
+			values[i] = value
+		}
+
+		return strings.Join(values, e.separator()), nil
+	}
+
+	resolver, ok := resolvers[e.resolveType()]
+	if !ok {
+		return "", fmt.Errorf("unknown environment resolution type: %s", e.resolveType())
+	}
+
+	if e.Cache != nil {
+		return cached(e, func() (string, error) {
+			return resolveWithRetries(e, resolver)
+		})
+	}
+
+	return resolveWithRetries(e, resolver)
+}
+
+func (e *Environment) resolveType() string {
+	if e.Type == nil {
+		return "static"
+	}
+	return *e.Type
+}
+
+func resolveWithRetries(e *Environment, resolver Resolver) (string, error) {
+	if e.Retries == nil || *e.Retries <= 0 {
+		return resolver.Resolve(e)
+	}
+
+	delay := defaultRetryDelay
+	if e.RetryDelay != nil {
+		var err error
+		if delay, err = time.ParseDuration(*e.RetryDelay); err != nil {
+			return "", err
+		}
+	}
+
+	// the delay doubles after every failed attempt
+	attempts := *e.Retries + 1
+	for attempt := 1; ; attempt++ {
+		value, err := resolver.Resolve(e)
+		if err == nil {
+			return value, nil
+		}
+
+		if attempt == attempts {
+			return "", fmt.Errorf("failed after %d attempts: %w", attempts, err)
+		}
+
+		warnf("env %s: attempt %d failed, retrying in %s: %s", e.ID, attempt, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// resolveError wraps err with the context and env it happened in, as in
+// context "prod" env "TOKEN" (file "/x"): ... Static sources are the value
+// itself and are left out.
+func resolveError(context *Context, e *Environment, err error) error {
+	typ := e.resolveType()
+	source := e.Source
+	if typ == "file" {
+		source = e.SourcePath()
+	}
+
+	if typ == "static" || source == "" {
+		return fmt.Errorf("context %q env %q (%s): %w", context.ID, e.ID, typ, err)
+	}
+
+	return fmt.Errorf("context %q env %q (%s %q): %w", context.ID, e.ID, typ, source, err)
+}
+
+// evaluateWhen reports whether e is included. Its when expression sees the
+// vars of the config and, as env.<NAME>, the process environment together
+// with the variables resolved before e.
+func evaluateWhen(e *Environment, env map[string]string) (bool, error) {
+	if e.When == nil {
+		return true, nil
+	}
+
+	values := make(map[string]cty.Value, len(env))
+	for name, value := range env {
+		values[name] = cty.StringVal(value)
+	}
+
+	var evalCtx *hcl.EvalContext
+	if e.evalCtx != nil {
+		evalCtx = e.evalCtx.NewChild()
+	} else {
+		evalCtx = &hcl.EvalContext{}
+	}
+	evalCtx.Variables = map[string]cty.Value{
+		"env": cty.ObjectVal(values),
+	}
+
+	val, diag := e.When.Value(evalCtx)
+	if diag.HasErrors() {
+		return false, diag
+	}
+
+	if val.IsNull() {
+		return true, nil
+	}
+
+	val, err := convert.Convert(val, cty.Bool)
+	if err != nil {
+		return false, fmt.Errorf("when must be a bool: %w", err)
+	}
+
+	return val.True(), nil
+}
+
+// validateEnvironment checks a resolved and transformed value against the
+// validate pattern and min_length of e. The value itself is never part of
+// the error.
+func validateEnvironment(e *Environment, value string) error {
+	if e.MinLength != nil && utf8.RuneCountInString(value) < *e.MinLength {
+		return fmt.Errorf("value is shorter than %d characters", *e.MinLength)
+	}
+
+	if e.Validate == nil {
+		return nil
+	}
+
+	pattern, err := regexp.Compile(*e.Validate)
+	if err != nil {
+		return fmt.Errorf("invalid validate pattern: %w", err)
+	}
+
+	if !pattern.MatchString(value) {
+		return fmt.Errorf("value does not match %s", *e.Validate)
+	}
+
+	return nil
+}
+
+// transformEnvironment applies the transforms listed on e, in order, to a value
+// resolved for it. A transform is either a name or a name and an argument
+// separated by a colon, as in "trimsuffix:/".
+func transformEnvironment(e *Environment, value string) (string, error) {
+	if e.Transform == nil {
+		return value, nil
+	}
+
+	val, diag := e.Transform.Value(nil)
+	if diag.HasErrors() {
+		return "", diag
+	}
+
+	if val.IsNull() {
+		return value, nil
+	}
+
+	var transforms []string
+	if val.Type() == cty.String {
+		transforms = []string{val.AsString()}
+	} else if diag = gohcl.DecodeExpression(e.Transform, nil, &transforms); diag.HasErrors() {
+		return "", diag
+	}
+
+	for _, t := range transforms {
+		name, arg, _ := strings.Cut(t, ":")
+		switch name {
+		case "upper":
+			value = strings.ToUpper(value)
+		case "lower":
+			value = strings.ToLower(value)
+		case "trim":
+			value = strings.TrimSpace(value)
+		case "trimprefix":
+			value = strings.TrimPrefix(value, arg)
+		case "trimsuffix":
+			value = strings.TrimSuffix(value, arg)
+		default:
+			return "", fmt.Errorf("unknown environment transform: %s", t)
+		}
+	}
+
+	return value, nil
+}
+
+// maxStderrLines is how many of the last lines a command printed on stderr a
+// failed command resolution reports.
+const maxStderrLines = 5
+
+// executeAndReturn runs args and returns what it printed on stdout. Its
+// stderr is captured, and its last lines are part of the error when it
+// fails; with stream set stderr is also printed while it runs.
+func executeAndReturn(args, envs []string, dir string, stream bool) (string, error) {
+	var (
+		cmd    = exec.Command(args[0], args[1:]...)
+		out    bytes.Buffer
+		stderr bytes.Buffer
+	)
+
+	cmd.Dir = dir
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = &stderr
+	if stream {
+		cmd.Stderr = io.MultiWriter(&stderr, os.Stderr)
+	}
+	cmd.Stdout = &out
+	cmd.Env = envs
+	if err := cmd.Run(); err != nil {
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		if len(lines) > maxStderrLines {
+			lines = lines[len(lines)-maxStderrLines:]
+		}
+		if tail := strings.Join(lines, "\n"); tail != "" {
+			return "", fmt.Errorf("%w: %s", err, tail)
+		}
+		return "", err
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
@@ -0,0 +1,122 @@
+package ctx
+
+import (
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Freeze resolves every env of contexts and their sub contexts and returns a
+// config defining them again with the resolved values as static sources, for
+// an environment that no longer depends on commands, files or the network.
+// Everything else the contexts set is kept as it is, import_env included.
+// Secret envs are left out with a warning unless includeSecrets is set, and
+// are then kept secret.
+func Freeze(contexts []*Context, includeSecrets bool) ([]byte, error) {
+	f := hclwrite.NewEmptyFile()
+	if err := freezeContexts(f.Body(), contexts, includeSecrets); err != nil {
+		return nil, err
+	}
+
+	return f.Bytes(), nil
+}
+
+func freezeContexts(body *hclwrite.Body, contexts []*Context, includeSecrets bool) error {
+	for i, c := range contexts {
+		if i > 0 {
+			body.AppendNewline()
+		}
+
+		block := body.AppendNewBlock("context", []string{c.ID}).Body()
+		for _, attribute := range []struct {
+			name  string
+			value cty.Value
+		}{
+			{"description", stringValue(c.Description)},
+			{"prompt", stringValue(c.Prompt)},
+			{"prompt_left", stringValue(c.PromptLeft)},
+			{"prompt_right", stringValue(c.PromptRight)},
+			{"prompt_inherit", boolValue(c.PromptInherit)},
+			{"prompt_prefix", stringValue(c.PromptPrefix)},
+			{"prompt_suffix", stringValue(c.PromptSuffix)},
+			{"env_prefix", stringValue(c.EnvPrefix)},
+			{"hidden", boolValue(c.Hidden)},
+			{"on_exit", stringValue(c.OnExit)},
+			{"cwd", stringValue(c.Cwd)},
+			{"default_command", stringValue(c.DefaultCommand)},
+			{"watch", boolValue(c.Watch)},
+			{"inherit", boolValue(c.Inherit)},
+			{"import_env", listValue(c.ImportEnv)},
+		} {
+			if !attribute.value.IsNull() {
+				block.SetAttributeValue(attribute.name, attribute.value)
+			}
+		}
+
+		variables, err := ResolveContext(c)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range variables {
+			// import_env is kept above, so it still imports when thawed
+			if v.Environment.imported {
+				continue
+			}
+
+			secret := v.Environment.IsSecret()
+			if secret && !includeSecrets {
+				warnf("secret env %s of context %s left out of the freeze", v.Environment.ID, c.ID)
+				continue
+			}
+
+			env := block.AppendNewBlock("env", []string{v.Environment.ID}).Body()
+			env.SetAttributeValue("source", cty.StringVal(v.Value))
+			if secret {
+				env.SetAttributeValue("secret", cty.True)
+			}
+		}
+
+		for _, command := range c.Commands {
+			block.AppendNewBlock("command", []string{command.ID}).Body().
+				SetAttributeValue("run", cty.StringVal(command.Run))
+		}
+
+		if len(c.SubContexts) > 0 {
+			block.AppendNewline()
+			if err := freezeContexts(block, c.SubContexts, includeSecrets); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// stringValue is the value of s, null when it is not set.
+func stringValue(s *string) cty.Value {
+	if s == nil {
+		return cty.NullVal(cty.String)
+	}
+	return cty.StringVal(*s)
+}
+
+// boolValue is the value of b, null when it is not set.
+func boolValue(b *bool) cty.Value {
+	if b == nil {
+		return cty.NullVal(cty.Bool)
+	}
+	return cty.BoolVal(*b)
+}
+
+// listValue is the value of list, null when it is empty.
+func listValue(list []string) cty.Value {
+	if len(list) == 0 {
+		return cty.NullVal(cty.List(cty.String))
+	}
+
+	values := make([]cty.Value, len(list))
+	for i, s := range list {
+		values[i] = cty.StringVal(s)
+	}
+	return cty.ListVal(values)
+}
@@ -0,0 +1,48 @@
+package ctx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const gcloudCommand = "gcloud"
+
+// resolveGCPSecret accesses a projects/<p>/secrets/<s>/versions/<v> secret
+// version with the Cloud SDK, using whatever credentials gcloud is set up
+// with.
+func resolveGCPSecret(e *Environment) (string, error) {
+	parts := strings.Split(e.Source, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "secrets" || parts[4] != "versions" {
+		return "", fmt.Errorf("gcp-secret source %s is not a projects/<p>/secrets/<s>/versions/<v> resource", e.Source)
+	}
+	project, secret, version := parts[1], parts[3], parts[5]
+
+	if _, err := exec.LookPath(gcloudCommand); err != nil {
+		return "", errors.New("gcp-secret source needs the Google Cloud SDK, gcloud not found on PATH")
+	}
+
+	var out, stderr bytes.Buffer
+	cmd := exec.Command(gcloudCommand, "secrets", "versions", "access", version,
+		"--secret", secret, "--project", project, "--quiet")
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		switch {
+		case strings.Contains(message, "gcloud auth login") || strings.Contains(message, "credentials"):
+			return "", fmt.Errorf("gcp-secret %s: not authenticated, run gcloud auth login", e.Source)
+		case strings.Contains(message, "PERMISSION_DENIED"):
+			return "", fmt.Errorf("gcp-secret %s: permission denied, the active account needs roles/secretmanager.secretAccessor", e.Source)
+		case strings.Contains(message, "NOT_FOUND"):
+			return "", fmt.Errorf("gcp-secret %s: secret version not found", e.Source)
+		case message == "":
+			message = err.Error()
+		}
+		return "", fmt.Errorf("gcp-secret %s: %s", e.Source, message)
+	}
+
+	return out.String(), nil
+}
@@ -0,0 +1,76 @@
+package ctx
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	defaultRandomLength  = 32
+	defaultRandomCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// resolveUUID generates a random version 4 UUID.
+func resolveUUID(e *Environment) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// resolveRandom generates a token of length characters drawn from charset,
+// 32 alphanumeric characters by default.
+func resolveRandom(e *Environment) (string, error) {
+	length := defaultRandomLength
+	if e.Length != nil {
+		length = *e.Length
+	}
+
+	charset := []rune(defaultRandomCharset)
+	if e.Charset != nil {
+		charset = []rune(*e.Charset)
+	}
+
+	if length < 0 {
+		return "", fmt.Errorf("random length %d is negative", length)
+	}
+
+	if len(charset) == 0 {
+		return "", errors.New("random charset is empty")
+	}
+
+	token := make([]rune, length)
+	max := big.NewInt(int64(len(charset)))
+	for i := range token {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		token[i] = charset[n.Int64()]
+	}
+
+	return string(token), nil
+}
+
+// resolveTimestamp formats the current time with the Go layout in the source,
+// RFC 3339 when it is empty, in local time unless utc is set.
+func resolveTimestamp(e *Environment) (string, error) {
+	layout := e.Source
+	if layout == "" {
+		layout = time.RFC3339
+	}
+
+	now := time.Now()
+	if e.UTC != nil && *e.UTC {
+		now = now.UTC()
+	}
+
+	return now.Format(layout), nil
+}
@@ -0,0 +1,66 @@
+package ctx
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const kubectlCommand = "kubectl"
+
+// resolveK8sSecret reads a key of a namespace/secret/key Kubernetes secret
+// with kubectl, which uses the current kubeconfig context, or the service
+// account of the pod when running inside a cluster without one.
+func resolveK8sSecret(e *Environment) (string, error) {
+	parts := strings.SplitN(e.Source, "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", fmt.Errorf("k8s-secret source %s is not a namespace/secret/key reference", e.Source)
+	}
+	namespace, secret, key := parts[0], parts[1], parts[2]
+
+	if _, err := exec.LookPath(kubectlCommand); err != nil {
+		return "", errors.New("k8s-secret source needs kubectl, kubectl not found on PATH")
+	}
+
+	var out, stderr bytes.Buffer
+	cmd := exec.Command(kubectlCommand, "get", "secret", secret, "--namespace", namespace, "--output", "json")
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		switch {
+		case strings.Contains(message, "Forbidden") || strings.Contains(message, "forbidden"):
+			return "", fmt.Errorf("k8s-secret %s: forbidden, the current user needs RBAC permission to get secrets in namespace %s", e.Source, namespace)
+		case strings.Contains(message, "Unauthorized") || strings.Contains(message, "must be logged in"):
+			return "", fmt.Errorf("k8s-secret %s: not authenticated to the cluster, check the credentials of the current kubeconfig context", e.Source)
+		case strings.Contains(message, "NotFound") || strings.Contains(message, "not found"):
+			return "", fmt.Errorf("k8s-secret %s: secret %s not found in namespace %s", e.Source, secret, namespace)
+		case message == "":
+			message = err.Error()
+		}
+		return "", fmt.Errorf("k8s-secret %s: %s", e.Source, message)
+	}
+
+	var object struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &object); err != nil {
+		return "", fmt.Errorf("k8s-secret %s: %w", e.Source, err)
+	}
+
+	data, ok := object.Data[key]
+	if !ok {
+		return "", fmt.Errorf("k8s-secret %s: secret %s has no key %s", e.Source, secret, key)
+	}
+
+	value, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("k8s-secret %s: %w", e.Source, err)
+	}
+
+	return string(value), nil
+}
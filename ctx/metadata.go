@@ -0,0 +1,41 @@
+package ctx
+
+import "strings"
+
+// Metadata describes an environment as the config defines it. It is built
+// without resolving anything, so listing a config full of commands and
+// secrets stays fast and runs nothing.
+type Metadata struct {
+	ID     string
+	Name   string
+	Type   string
+	Source string
+	Secret bool
+}
+
+// Metadata describes the environments of c, in order, with the env_prefix of
+// c applied to their names. Unlike ResolveContext it never resolves a value.
+func (c *Context) Metadata() []Metadata {
+	var prefix string
+	if c.EnvPrefix != nil {
+		prefix = *c.EnvPrefix
+	}
+
+	metadata := make([]Metadata, 0, len(c.Environments))
+	for _, e := range c.Environments {
+		source := e.Source
+		if len(e.Sources) > 0 {
+			source = strings.Join(e.Sources, e.separator())
+		}
+
+		metadata = append(metadata, Metadata{
+			ID:     e.ID,
+			Name:   prefix + e.ID,
+			Type:   e.resolveType(),
+			Source: source,
+			Secret: e.IsSecret(),
+		})
+	}
+
+	return metadata
+}
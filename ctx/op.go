@@ -0,0 +1,41 @@
+package ctx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const opCommand = "op"
+
+// resolveOp reads an op://vault/item/field secret reference with the
+// 1Password CLI.
+func resolveOp(e *Environment) (string, error) {
+	if !strings.HasPrefix(e.Source, "op://") {
+		return "", fmt.Errorf("op source %s is not an op://vault/item/field reference", e.Source)
+	}
+
+	if _, err := exec.LookPath(opCommand); err != nil {
+		return "", errors.New("op source needs the 1Password CLI, op not found on PATH")
+	}
+
+	var out, stderr bytes.Buffer
+	cmd := exec.Command(opCommand, "read", "--no-newline", e.Source)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if strings.Contains(message, "not currently signed in") || strings.Contains(message, "signin") {
+			return "", fmt.Errorf("op read %s: not signed in to 1Password, run op signin", e.Source)
+		}
+
+		if message == "" {
+			message = err.Error()
+		}
+		return "", fmt.Errorf("op read %s: %s", e.Source, message)
+	}
+
+	return out.String(), nil
+}
@@ -0,0 +1,306 @@
+package ctx
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	defaultTimeout     = 30 * time.Second
+	defaultMaxFileSize = 1 << 20
+)
+
+// Resolver produces the value of an environment from its source.
+type Resolver interface {
+	Resolve(e *Environment) (string, error)
+}
+
+// ResolverFunc adapts an ordinary function to a Resolver.
+type ResolverFunc func(e *Environment) (string, error)
+
+// Resolve calls f(e).
+func (f ResolverFunc) Resolve(e *Environment) (string, error) {
+	return f(e)
+}
+
+var resolvers = map[string]Resolver{
+	"static":     ResolverFunc(resolveStatic),
+	"file":       ResolverFunc(resolveFile),
+	"dotenv":     ResolverFunc(resolveDotenv),
+	"command":    ResolverFunc(resolveCommand),
+	"plugin":     ResolverFunc(resolvePlugin),
+	"url":        ResolverFunc(resolveURL),
+	"op":         ResolverFunc(resolveOp),
+	"gcp-secret": ResolverFunc(resolveGCPSecret),
+	"k8s-secret": ResolverFunc(resolveK8sSecret),
+	"uuid":       ResolverFunc(resolveUUID),
+	"random":     ResolverFunc(resolveRandom),
+	"timestamp":  ResolverFunc(resolveTimestamp),
+}
+
+// RegisterResolver makes r available as the environment type name, replacing
+// any resolver registered under the same name. It is not safe to call
+// concurrently with ResolveEnvironment and is meant to be called from init.
+func RegisterResolver(name string, r Resolver) {
+	resolvers[name] = r
+}
+
+// resolveStatic returns the source, with the common indentation of its lines
+// removed when dedent is set and surrounding whitespace removed when trim is
+// set.
+func resolveStatic(e *Environment) (string, error) {
+	value := e.Source
+	if e.Dedent != nil && *e.Dedent {
+		value = dedent(value)
+	}
+
+	if e.Trim != nil && *e.Trim {
+		value = strings.TrimSpace(value)
+	}
+
+	return value, nil
+}
+
+func dedent(s string) string {
+	lines := strings.Split(s, "\n")
+
+	indent := -1
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		n := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+
+	if indent <= 0 {
+		return s
+	}
+
+	for i, line := range lines {
+		if len(line) >= indent {
+			lines[i] = line[indent:]
+		} else {
+			lines[i] = strings.TrimLeft(line, " \t")
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// resolveFile reads the source file, refusing files larger than max_size
+// bytes, 1 MiB by default.
+func resolveFile(e *Environment) (string, error) {
+	limit := int64(defaultMaxFileSize)
+	if e.MaxSize != nil {
+		limit = *e.MaxSize
+	}
+
+	f, err := os.Open(e.SourcePath())
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return "", err
+	}
+
+	if int64(len(content)) > limit {
+		return "", fmt.Errorf("file %s is larger than %d bytes", e.SourcePath(), limit)
+	}
+
+	var encoding string
+	if e.Encoding != nil {
+		encoding = *e.Encoding
+	}
+
+	return decodeFile(content, encoding)
+}
+
+// decodeFile converts content in encoding to UTF-8. utf16 reads the byte
+// order from a BOM and falls back to little endian; a BOM is dropped in every
+// UTF-16 encoding.
+func decodeFile(content []byte, encoding string) (string, error) {
+	var order binary.ByteOrder
+	switch encoding {
+	case "", "utf8":
+		return string(content), nil
+	case "utf16le":
+		order = binary.LittleEndian
+	case "utf16be":
+		order = binary.BigEndian
+	case "utf16":
+		order = binary.LittleEndian
+		if bytes.HasPrefix(content, []byte{0xfe, 0xff}) {
+			order = binary.BigEndian
+		}
+	default:
+		return "", fmt.Errorf("unknown encoding: %s", encoding)
+	}
+
+	if len(content)%2 != 0 {
+		return "", fmt.Errorf("file is not %s, odd number of bytes", encoding)
+	}
+
+	units := make([]uint16, 0, len(content)/2)
+	for i := 0; i < len(content); i += 2 {
+		units = append(units, order.Uint16(content[i:]))
+	}
+
+	if len(units) > 0 && units[0] == 0xfeff {
+		units = units[1:]
+	}
+
+	return string(utf16.Decode(units)), nil
+}
+
+// commandMu is held while a command env runs.
+var commandMu sync.Mutex
+
+func resolveCommand(e *Environment) (string, error) {
+	envs, args, err := e.commandArgs()
+	if err != nil {
+		return "", err
+	}
+
+	if len(args) == 0 {
+		return "", errors.New("command source names no executable")
+	}
+
+	// commands share the terminal, so while other envs resolve concurrently
+	// they run one at a time, each reading stdin undisturbed
+	commandMu.Lock()
+	defer commandMu.Unlock()
+
+	stream := e.StreamStderr != nil && *e.StreamStderr
+	content, err := executeAndReturn(args, e.commandEnv(envs), e.dir, stream)
+	if err != nil {
+		return "", err
+	}
+	return extractOutput(e, content)
+}
+
+// extractOutput picks the line and then the field e asks for out of the
+// output of a command. Both count from 1; fields are split by delim, or by
+// whitespace when it is not set.
+func extractOutput(e *Environment, content string) (string, error) {
+	if e.Line != nil {
+		lines := strings.Split(content, "\n")
+		if *e.Line < 1 || *e.Line > len(lines) {
+			return "", fmt.Errorf("command output has %d lines, no line %d", len(lines), *e.Line)
+		}
+		content = strings.TrimSpace(lines[*e.Line-1])
+	}
+
+	if e.Field != nil {
+		var fields []string
+		if e.Delim != nil && *e.Delim != "" {
+			fields = strings.Split(content, *e.Delim)
+		} else {
+			fields = strings.Fields(content)
+		}
+
+		if *e.Field < 1 || *e.Field > len(fields) {
+			return "", fmt.Errorf("command output has %d fields, no field %d", len(fields), *e.Field)
+		}
+		content = strings.TrimSpace(fields[*e.Field-1])
+	}
+
+	return content, nil
+}
+
+// pluginRequest is written as JSON to the standard input of a plugin.
+type pluginRequest struct {
+	ID   string   `json:"id"`
+	Args []string `json:"args"`
+}
+
+// resolvePlugin runs the executable named by the first word of the source.
+// The plugin receives a pluginRequest carrying the environment ID and the
+// remaining words of the source on stdin, and must print the value to stdout
+// and exit zero. Surrounding whitespace of the output is trimmed. A plugin
+// running longer than the environment timeout, 30s by default, is killed.
+func resolvePlugin(e *Environment) (string, error) {
+	envs, args, err := e.commandArgs()
+	if err != nil {
+		return "", err
+	}
+
+	if len(args) == 0 {
+		return "", errors.New("plugin source names no executable")
+	}
+
+	timeout, err := environmentTimeout(e)
+	if err != nil {
+		return "", err
+	}
+
+	request, err := json.Marshal(pluginRequest{ID: e.ID, Args: args[1:]})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0])
+	cmd.Dir = e.dir
+	cmd.Env = e.commandEnv(envs)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("plugin %s timed out after %s", args[0], timeout)
+		}
+		return "", fmt.Errorf("plugin %s: %w", args[0], err)
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
+
+func environmentTimeout(e *Environment) (time.Duration, error) {
+	if e.Timeout == nil {
+		return defaultTimeout, nil
+	}
+	return time.ParseDuration(*e.Timeout)
+}
+
+// commandEnv returns the environment a command or plugin of e runs in,
+// extended with envs: the process environment, or with context_env set the
+// environment ResolveContext built from the envs defined before e.
+func (e *Environment) commandEnv(envs []string) []string {
+	environ := e.environ
+	if environ == nil {
+		environ = os.Environ()
+	}
+
+	return append(environ[:len(environ):len(environ)], envs...)
+}
+
+// SourcePath returns the source of a file environment, anchored to
+// ConfigDir when relative.
+func (e *Environment) SourcePath() string {
+	if filepath.IsAbs(e.Source) || e.dir == "" {
+		return e.Source
+	}
+	return filepath.Join(e.dir, e.Source)
+}
@@ -0,0 +1,35 @@
+package ctx
+
+import (
+	"runtime"
+	"strings"
+
+	"github.com/mattn/go-shellwords"
+)
+
+// SplitCommand splits a command line into leading KEY=VALUE assignments and
+// the command with its arguments, the way a POSIX shell would. On Windows a
+// backslash is a path separator rather than an escape, so paths such as
+// C:\Tools\bash.exe survive; quote arguments containing spaces there.
+func SplitCommand(line string) (envs, args []string, err error) {
+	return splitCommand(line, runtime.GOOS)
+}
+
+// splitCommand is SplitCommand as it behaves on goos.
+func splitCommand(line, goos string) (envs, args []string, err error) {
+	if goos == "windows" {
+		line = strings.ReplaceAll(line, `\`, `\\`)
+	}
+
+	return shellwords.ParseWithEnvs(line)
+}
+
+// commandArgs returns how the command of e is run: its args when they are
+// set, otherwise its source split by SplitCommand.
+func (e *Environment) commandArgs() (envs, args []string, err error) {
+	if len(e.Args) > 0 {
+		return nil, e.Args, nil
+	}
+
+	return SplitCommand(e.Source)
+}
@@ -0,0 +1,80 @@
+package ctx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		goos string
+		line string
+		envs []string
+		args []string
+		err  bool
+	}{
+		{goos: "linux", line: `echo "a b" 'c d'`, args: []string{"echo", "a b", "c d"}},
+		{goos: "linux", line: `A=1 B="x y" cmd arg`, envs: []string{"A=1", "B=x y"}, args: []string{"cmd", "arg"}},
+		{goos: "linux", line: `A=1`, envs: []string{"A=1"}},
+		{goos: "linux", line: `echo a\ b`, args: []string{"echo", "a b"}},
+		{goos: "linux", line: `echo a\\b`, args: []string{"echo", `a\b`}},
+		{goos: "linux", line: `echo "it's" 'say "hi"'`, args: []string{"echo", "it's", `say "hi"`}},
+		{goos: "linux", line: `echo "a\"b"`, args: []string{"echo", `a"b`}},
+		{goos: "linux", line: `echo "" x`, args: []string{"echo", "", "x"}},
+		{goos: "linux", line: `echo $HOME`, args: []string{"echo", "$HOME"}},
+		{goos: "linux", line: `echo "unterminated`, err: true},
+		{goos: "linux", line: `C:\Tools\bash.exe -c "echo hi"`, args: []string{"C:Toolsbash.exe", "-c", "echo hi"}},
+
+		// on windows a backslash is kept as a path separator
+		{goos: "windows", line: `C:\Tools\bash.exe -c "echo hi"`, args: []string{`C:\Tools\bash.exe`, "-c", "echo hi"}},
+		{goos: "windows", line: `"C:\Program Files\x.exe" a`, args: []string{`C:\Program Files\x.exe`, "a"}},
+		{goos: "windows", line: `A=C:\tmp cmd`, envs: []string{`A=C:\tmp`}, args: []string{"cmd"}},
+		{goos: "windows", line: `echo a\ b`, args: []string{"echo", `a\`, "b"}},
+		{goos: "windows", line: `echo "a b" 'c d'`, args: []string{"echo", "a b", "c d"}},
+		{goos: "windows", line: `echo "a\"b"`, err: true},
+	}
+
+	for _, test := range tests {
+		envs, args, err := splitCommand(test.line, test.goos)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: splitCommand(%q) = %q, %q, want an error", test.goos, test.line, envs, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: splitCommand(%q): %v", test.goos, test.line, err)
+			continue
+		}
+
+		if len(envs) == 0 {
+			envs = nil
+		}
+		if len(args) == 0 {
+			args = nil
+		}
+		if !reflect.DeepEqual(envs, test.envs) || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: splitCommand(%q) = %q, %q, want %q, %q", test.goos, test.line, envs, args, test.envs, test.args)
+		}
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	e := &Environment{Source: "ignored here", Args: []string{"echo", "a b"}}
+	envs, args, err := e.commandArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envs != nil || !reflect.DeepEqual(args, e.Args) {
+		t.Errorf("commandArgs() = %q, %q, want args as they are", envs, args)
+	}
+
+	e = &Environment{Source: `X=1 echo "a b"`}
+	envs, args, err = e.commandArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(envs, []string{"X=1"}) || !reflect.DeepEqual(args, []string{"echo", "a b"}) {
+		t.Errorf("commandArgs() = %q, %q, want the source split", envs, args)
+	}
+}
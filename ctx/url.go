@@ -0,0 +1,33 @@
+package ctx
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// resolveURL fetches the source with a GET request.
+func resolveURL(e *Environment) (string, error) {
+	timeout, err := environmentTimeout(e)
+	if err != nil {
+		return "", err
+	}
+
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(e.Source)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("GET %s: %s", e.Source, resp.Status)
+	}
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
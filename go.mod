@@ -3,8 +3,11 @@ module github.com/sgx79/ctxcli
 go 1.18
 
 require (
+	github.com/creack/pty v1.1.21
 	github.com/hashicorp/hcl/v2 v2.14.0
 	github.com/mattn/go-shellwords v1.0.12
+	github.com/zclconf/go-cty v1.11.0
+	golang.org/x/term v0.5.0
 )
 
 require (
@@ -12,6 +15,6 @@ require (
 	github.com/apparentlymart/go-textseg/v13 v13.0.0 // indirect
 	github.com/google/go-cmp v0.5.9 // indirect
 	github.com/mitchellh/go-wordwrap v1.0.1 // indirect
-	github.com/zclconf/go-cty v1.11.0 // indirect
+	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/text v0.3.7 // indirect
 )
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sgx79/ctxcli/ctx"
+)
+
+// maxHistory caps the number of context switches kept in the history file.
+const maxHistory = 100
+
+// historyEntry is a context switch, when it happened and the full path of
+// the context entered.
+type historyEntry struct {
+	time time.Time
+	path string
+}
+
+// historyFile returns where the history is kept: $XDG_STATE_HOME/ctx, or the
+// ctx directory of the user config directory. It stays out of the cache
+// directory, which clear-cache removes.
+func historyFile() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		var err error
+		if dir, err = os.UserConfigDir(); err != nil {
+			return "", err
+		}
+	}
+
+	return filepath.Join(dir, "ctx", "history"), nil
+}
+
+// readHistory returns the recorded context switches, oldest first. A missing
+// history file is an empty history.
+func readHistory() ([]historyEntry, error) {
+	file, err := historyFile()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		stamp, path, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, stamp)
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, historyEntry{time: t, path: path})
+	}
+
+	return entries, scanner.Err()
+}
+
+// recordHistory appends a switch to path to the history, dropping the oldest
+// switches beyond maxHistory. History is a convenience, so failing to keep
+// it is only a warning.
+func recordHistory(path string) {
+	entries, err := readHistory()
+	if err == nil {
+		entries = append(entries, historyEntry{time: time.Now(), path: path})
+		if len(entries) > maxHistory {
+			entries = entries[len(entries)-maxHistory:]
+		}
+		err = writeHistory(entries)
+	}
+
+	if err != nil {
+		warnf("can not record history: %s", err)
+	}
+}
+
+func writeHistory(entries []historyEntry) error {
+	file, err := historyFile()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&content, "%s\t%s\n", entry.time.Format(time.RFC3339), entry.path)
+	}
+
+	return os.WriteFile(file, []byte(content.String()), 0600)
+}
+
+// handleHistory lists the recent context switches, most recent first and
+// numbered from 1. With an argument it enters the context of that switch.
+func handleHistory(config *ctx.Config, args []string) error {
+	entries, err := readHistory()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		for i := len(entries) - 1; i >= 0; i-- {
+			fmt.Printf("%3d  %s  %s\n", len(entries)-i, entries[i].time.Local().Format("2006-01-02 15:04"), entries[i].path)
+		}
+		return nil
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || n > len(entries) {
+		return fmt.Errorf("no history entry %s", args[0])
+	}
+
+	return handleSet(config, "/"+entries[len(entries)-n].path, "", true)
+}
@@ -2,331 +2,1394 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
-	"github.com/hashicorp/hcl/v2/gohcl"
-	"github.com/hashicorp/hcl/v2/hclparse"
-	"github.com/mattn/go-shellwords"
+	"github.com/sgx79/ctxcli/ctx"
 )
 
 const (
-	fzfCommand   = "fzf"
-	ctxActiveEnv = "CTX_ACTIVE"
+	fzfCommand      = "fzf"
+	defaultMaxDepth = 8
+	maskValue       = "********"
 )
 
-type Environment struct {
-	ID     string  `hcl:",label"`
-	Type   *string `hcl:"type"`
-	Source string  `hcl:"source"`
+const (
+	exitFailure  = 1
+	exitConfig   = 2
+	exitNotFound = 3
+	exitResolve  = 4
+	exitTimeout  = 124
+)
+
+func main() {
+	opts, err := parseArgs(os.Args[1:])
+	if err != nil {
+		printError(err)
+		os.Exit(exitFailure)
+	}
+
+	if opts.help && opts.command != "" {
+		printCommandUsage(opts.command)
+		os.Exit(0)
+	}
+
+	if opts.help {
+		printUsage()
+		os.Exit(0)
+	}
+
+	if opts.configFile == "" {
+		opts.configFile = os.Getenv("CTX_CONFIG")
+	}
+
+	if opts.quiet {
+		ctx.Warnings = io.Discard
+	}
+
+	// -C stands in for the active context of every handler. The process
+	// environment holds none of its variables, so the variables of the
+	// context ctx runs in are dropped and ManagedEnv no longer claims them;
+	// every context on a path is then resolved from the top.
+	if opts.active != "" {
+		if names, ok := ctx.ManagedNames(); ok {
+			for _, name := range names {
+				os.Unsetenv(name)
+			}
+		}
+		os.Unsetenv(ctx.ManagedEnv)
+		os.Setenv(ctx.ActiveEnv, strings.TrimPrefix(opts.active, "/"))
+	}
+
+	// --print-config is dump of the merged config, whatever the command
+	if opts.printConfig {
+		opts.command = "dump"
+	}
+
+	if opts.command == "" {
+		opts.command = "set"
+	}
+
+	var config ctx.Config
+
+	switch opts.command {
+	case "set":
+		loadConfig(opts, &config)
+		err = handleSet(&config, opts.contextID, opts.query, !opts.noFzf)
+	case "exec":
+		loadConfig(opts, &config)
+		err = handleExec(&config, opts.contextID, opts.cwd, opts.timeout, opts.login, opts.interactive, opts.envs, opts.rest)
+	case "prompt":
+		handlePrompt(opts.configFile, opts.promptContext, opts.side, opts.promptShell, opts.exitStatus)
+	case "list":
+		loadConfig(opts, &config)
+		if opts.jsonTree {
+			err = handleListTree(&config, opts.reveal)
+		} else if opts.activeOnly {
+			err = handleListActive(&config)
+		} else {
+			err = handleList(&config, opts.all, opts.paths, opts.sorted, opts.reverse, opts.long)
+		}
+	case "dump":
+		loadConfig(opts, &config)
+		err = handleDump(&config, opts.configFile, opts.format, opts.printConfig)
+	case "edit":
+		loadConfig(opts, &config)
+		err = handleEdit(opts.configFile)
+	case "validate":
+		loadConfig(opts, &config)
+		if err = ctx.Check(&config); err != nil {
+			err = withExitCode(exitConfig, err)
+		} else {
+			fmt.Println("config is valid")
+		}
+	case "doctor":
+		err = handleDoctor(opts.configFile)
+	case "graph":
+		loadConfig(opts, &config)
+		err = handleGraph(&config, opts.envCount)
+	case "clear-cache":
+		if len(opts.rest) == 0 {
+			err = handleClearCache(nil, opts.rest)
+			break
+		}
+
+		loadConfig(opts, &config)
+		err = handleClearCache(&config, opts.rest)
+	case "up", "parent":
+		loadConfig(opts, &config)
+		err = handleUp(&config)
+	case "do":
+		loadConfig(opts, &config)
+		err = handleDo(&config, opts.rest)
+	case "env":
+		loadConfig(opts, &config)
+		args := opts.rest
+		list := len(args) > 0 && args[0] == "list"
+		if list {
+			args = args[1:]
+		}
+
+		var target string
+		if len(args) > 0 {
+			target = args[0]
+		}
+
+		if list {
+			err = handleEnvList(&config, target)
+		} else {
+			err = handleEnv(&config, target, opts.showSecrets, opts.json, opts.reveal)
+		}
+	case "add-context":
+		loadConfig(opts, &config)
+		err = handleAddContext(opts.configFile, opts.rest)
+	case "add-env":
+		loadConfig(opts, &config)
+		err = handleAddEnv(&config, opts.configFile, opts.envType, opts.source, opts.rest)
+	case "run":
+		loadConfig(opts, &config)
+		if len(opts.rest) == 0 {
+			err = errors.New("what command should run")
+		} else {
+			err = handleRun(&config, opts.contextID, opts.rest)
+		}
+	case "merge":
+		loadConfig(opts, &config)
+		if opts.dashes < 0 || opts.dashes == len(opts.rest) {
+			err = errors.New("what command should execute, merge needs -- <command>")
+		} else {
+			err = handleMerge(&config, opts.rest[:opts.dashes], opts.rest[opts.dashes:])
+		}
+	case "history":
+		loadConfig(opts, &config)
+		err = handleHistory(&config, opts.rest)
+	case "changed":
+		loadConfig(opts, &config)
+		var changed bool
+		if changed, err = handleChanged(&config); err == nil && !changed {
+			os.Exit(exitFailure)
+		}
+	case "help":
+		if len(opts.rest) == 0 {
+			printUsage()
+			break
+		}
+
+		// help <command> describes the command, also without a config,
+		// unless the config has a context called so
+		target := opts.rest[0]
+		if command, _ := matchCommand(target); command != "" {
+			if ctx.ParseConfig(opts.configFile, &config) != nil || ctx.Lookup(&config, targetPath(target)) == nil {
+				printCommandUsage(command)
+				break
+			}
+		} else {
+			loadConfig(opts, &config)
+		}
+		err = handleHelp(&config, target)
+	case "freeze":
+		loadConfig(opts, &config)
+		var target string
+		if len(opts.rest) > 0 {
+			target = opts.rest[0]
+		}
+
+		err = handleFreeze(&config, target, opts.includeSecrets)
+	case "rename":
+		loadConfig(opts, &config)
+		err = handleRename(&config, opts.configFile, opts.rest)
+	case "version":
+		handleVersion()
+	case "shell-init":
+		var shell string
+		if len(opts.rest) > 0 {
+			shell = opts.rest[0]
+		}
+
+		err = handleShellInit(shell)
+	}
+
+	if err != nil {
+		var coded *codedError
+		var exitErr *exec.ExitError
+		if errors.As(err, &coded) || !errors.As(err, &exitErr) {
+			printError(err)
+		}
+		os.Exit(exitCode(err))
+	}
+
+	os.Exit(0)
+}
+
+// printUsage prints the usage of all commands.
+func printUsage() {
+	fmt.Println("usage: ctx [--quiet] [--strict] [--parallel <n>] [-C <path>] [--print-config [--format hcl|json]] [set [--query <text>] [--no-fzf] <argment> | exec [--cwd <dir>] [--env KEY=VALUE]... [--login] [--interactive] [--timeout <duration>] <argment> [-- <command>] | run <argment> -- <command> | prompt [--context <path>] [--side left|right] [--exit-status <n>] [--shell bash|zsh|fish] | list [--all] [--paths] [--sort] [--reverse] [--long] [--json-tree [--reveal <n>]] [--active-only] | edit | add-context <path> | add-env [--type <type>] [--source <source>] <context> <id> | rename <context> <id> | merge <context> <context>... -- <command> | history [<n>] | freeze [--include-secrets] [<context>] | changed | dump [--format hcl|json] | validate | doctor | graph [--env-count] | clear-cache [<context> [<env>]] | shell-init <bash|zsh|fish> | up | do [<context>] [<command>] | env [--show-secrets] [--reveal <n>] [--json] [<context>] | env list [<context>] | version | help [<context>|<command>]]")
+	fmt.Println()
+	fmt.Println("  if", fzfCommand, "is installed, no argument is need to set context")
+	fmt.Println()
+}
+
+// printCommandUsage prints the usage of command for ctx <command> --help.
+func printCommandUsage(command string) {
+	if command == "parent" {
+		command = "up"
+	}
+	fmt.Println(commandUsage[command])
+	fmt.Println()
+}
+
+// loadConfig parses the config file of opts into config, and checks it with
+// --strict, exiting when it can not. It applies the settings of config that
+// flags did not override.
+func loadConfig(opts *options, config *ctx.Config) {
+	if err := ctx.ParseConfig(opts.configFile, config); err != nil {
+		printError(err)
+		os.Exit(exitConfig)
+	}
+
+	if opts.strict {
+		if err := ctx.Check(config); err != nil {
+			printError(err)
+			os.Exit(exitConfig)
+		}
+	}
+
+	if opts.parallel > 0 {
+		ctx.Parallel = opts.parallel
+	} else if config.Parallel != nil && *config.Parallel > 0 {
+		ctx.Parallel = *config.Parallel
+	}
+}
+
+// codedError attaches the process exit code main should use to an error.
+type codedError struct {
+	code int
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &codedError{code: code, err: err}
+}
+
+// exitCode maps err to a process exit code. Errors from a child process
+// started by exec or set pass its exit code through.
+func exitCode(err error) int {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+
+	return exitFailure
+}
+
+// resolveContext finds the context addressed by target. A target starting
+// with "/" is a path from the top level, any other target is a path relative
+// to the active context. The full path of the context is returned with it.
+func resolveContext(config *ctx.Config, target string) (*ctx.Context, string, error) {
+	return findContext(config, target, ctx.FindPath)
+}
+
+// findContext is resolveContext, looking up the full path of target with
+// find.
+func findContext(config *ctx.Config, target string, find func(*ctx.Config, string) ([]*ctx.Context, error)) (*ctx.Context, string, error) {
+	if active := os.Getenv(ctx.ActiveEnv); active != "" && !strings.HasPrefix(target, "/") {
+		if _, err := ctx.FindPath(config, active); err != nil {
+			return nil, "", withExitCode(exitNotFound, fmt.Errorf("internal error, current context not found: %w", err))
+		}
+	}
+
+	path := targetPath(target)
+
+	contexts, err := find(config, path)
+	if err != nil {
+		return nil, "", withExitCode(exitNotFound, err)
+	}
+
+	return contexts[len(contexts)-1], ctx.ContextPath(contexts), nil
+}
+
+// targetPath turns target into a full path, as resolveContext does, without
+// requiring the context to exist.
+func targetPath(target string) string {
+	if strings.HasPrefix(target, "/") {
+		return target[1:]
+	}
+
+	if active := os.Getenv(ctx.ActiveEnv); active != "" {
+		return active + "," + target
+	}
+
+	return target
+}
+
+// activeContext finds the context named by ActiveEnv. A nil context is
+// returned when no context is active.
+func activeContext(config *ctx.Config) (*ctx.Context, string, error) {
+	path := os.Getenv(ctx.ActiveEnv)
+	if path == "" {
+		return nil, "", nil
+	}
+
+	contexts, err := ctx.FindPath(config, path)
+	if err != nil {
+		return nil, "", withExitCode(exitNotFound, fmt.Errorf("internal error, current context not found: %w", err))
+	}
+
+	return contexts[len(contexts)-1], path, nil
+}
+
+func handleExec(config *ctx.Config, ctxid, cwd string, timeout time.Duration, login, interactive bool, envs, args []string) error {
+	for _, e := range envs {
+		if !strings.Contains(e, "=") {
+			return fmt.Errorf("--env %s is not in KEY=VALUE form", e)
+		}
+	}
+
+	c, path, err := resolveContext(config, ctxid)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		if c.DefaultCommand == nil || *c.DefaultCommand == "" {
+			return fmt.Errorf("what command should execute, context %s has no default_command", path)
+		}
+
+		var commandEnvs []string
+		if commandEnvs, args, err = ctx.SplitCommand(*c.DefaultCommand); err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("default_command of context %s has nothing to run", path)
+		}
+
+		envs = append(commandEnvs, envs...)
+	}
+
+	if cwd != "" {
+		if cwd, err = expandPath(cwd); err != nil {
+			return err
+		}
+	}
+
+	if login {
+		if args, err = loginCommand(args); err != nil {
+			return err
+		}
+	}
+
+	return runInContext(config, path, cwd, timeout, interactive, envs, args)
+}
+
+// loginCommand wraps args to run through a login shell of $SHELL, so its rc
+// files apply to the command.
+func loginCommand(args []string) ([]string, error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		return nil, errors.New("--login needs SHELL to be set")
+	}
+
+	quote := posixQuote
+	if filepath.Base(shell) == "fish" {
+		quote = fishQuote
+	}
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quote(arg)
+	}
+
+	return []string{shell, "-l", "-c", strings.Join(quoted, " ")}, nil
+}
+
+// runInContext runs args in the environment of the context at path,
+// extended with envs, in cwd when it is set and on a pseudo terminal when
+// interactive is set. A command running longer than a non-zero timeout is
+// killed.
+func runInContext(config *ctx.Config, path, cwd string, timeout time.Duration, interactive bool, envs, args []string) error {
+	environmentVariables, err := ctx.GenerateEnvironment(config, path, envs)
+	if err != nil {
+		return withExitCode(exitResolve, err)
+	}
+
+	runCtx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(runCtx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(runCtx, args[0], args[1:]...)
+	cmd.Dir = cwd
+	cmd.Env = environmentVariables
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if interactive {
+		err = runInPty(cmd)
+	} else {
+		err = cmd.Run()
+	}
+	if runCtx.Err() == context.DeadlineExceeded {
+		return withExitCode(exitTimeout, fmt.Errorf("%s timed out after %s", args[0], timeout))
+	}
+
+	return err
+}
+
+// handleEnv prints the variables the context addressed by target, or the
+// active context, defines, as KEY=value lines or a JSON object. Secret values
+// are masked unless showSecrets is set, revealing reveal characters at
+// either end.
+func handleEnv(config *ctx.Config, target string, showSecrets, asJSON bool, reveal int) error {
+	c, err := envContext(config, target)
+	if err != nil {
+		return err
+	}
+
+	variables, err := ctx.ResolveContext(c)
+	if err != nil {
+		return withExitCode(exitResolve, err)
+	}
+
+	if asJSON {
+		values := make(map[string]string, len(variables))
+		for _, v := range variables {
+			values[v.Name] = v.Value
+			if !showSecrets && v.Environment.IsSecret() {
+				values[v.Name] = mask(v.Value, reveal)
+			}
+		}
+
+		out, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(out))
+		return nil
+	}
+
+	for _, v := range variables {
+		value := v.Environment.Pretty(v.Value)
+		if !showSecrets && v.Environment.IsSecret() {
+			value = mask(v.Value, reveal)
+		}
+		fmt.Printf("%s=%s\n", v.Name, value)
+	}
+
+	return nil
+}
+
+// mask hides a secret value behind maskValue. With reveal above zero the
+// first and last reveal characters stay visible, as long as at least as many
+// characters are hidden as shown; the width of the mask never depends on the
+// value.
+func mask(value string, reveal int) string {
+	runes := []rune(value)
+	if reveal <= 0 || len(runes) < 4*reveal {
+		return maskValue
+	}
+
+	return string(runes[:reveal]) + maskValue + string(runes[len(runes)-reveal:])
+}
+
+// handleEnvList prints the IDs and types of the envs the context at target
+// defines, the active context by default, without resolving any of them.
+func handleEnvList(config *ctx.Config, target string) error {
+	c, err := envContext(config, target)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, m := range c.Metadata() {
+		fmt.Fprintf(w, "%s\t%s\n", m.ID, m.Type)
+	}
+
+	return w.Flush()
+}
+
+// envContext returns the context at target, or the active context when
+// target is empty, for env to show.
+func envContext(config *ctx.Config, target string) (*ctx.Context, error) {
+	if target != "" {
+		c, _, err := resolveContext(config, target)
+		return c, err
+	}
+
+	c, _, err := activeContext(config)
+	if err == nil && c == nil {
+		err = errors.New("no active context, which context should be shown")
+	}
+
+	return c, err
+}
+
+// handleRun replaces ctx with args, run in the context addressed by ctxid,
+// so no ctx process stays around while it runs.
+func handleRun(config *ctx.Config, ctxid string, args []string) error {
+	_, path, err := resolveContext(config, ctxid)
+	if err != nil {
+		return err
+	}
+
+	environmentVariables, err := ctx.GenerateEnvironment(config, path, nil)
+	if err != nil {
+		return withExitCode(exitResolve, err)
+	}
+
+	return replaceProcess(args, environmentVariables)
+}
+
+// handleMerge runs args with the environments of every context addressed by
+// targets, resolved in order so that later contexts override earlier ones.
+// Every context on the path of a target is resolved, and the last context is
+// the active one.
+func handleMerge(config *ctx.Config, targets, args []string) error {
+	if len(targets) < 2 {
+		return errors.New("merge needs at least two contexts")
+	}
+
+	paths := make([]string, len(targets))
+	for i, target := range targets {
+		_, path, err := resolveContext(config, target)
+		if err != nil {
+			return err
+		}
+		paths[i] = path
+	}
+
+	environmentVariables, err := ctx.MergeEnvironment(config, paths)
+	if err != nil {
+		return withExitCode(exitResolve, err)
+	}
+
+	return execute(args, environmentVariables)
+}
+
+// handleDo runs a command block. With no args it lists the commands of the
+// active context, one arg names a command of the active context or else a
+// context path whose commands are listed, and two args are a context path and
+// a command of that context.
+func handleDo(config *ctx.Config, args []string) error {
+	var c *ctx.Context
+	var path string
+
+	if len(args) == 2 {
+		var err error
+		if c, path, err = resolveContext(config, args[0]); err != nil {
+			return err
+		}
+		args = args[1:]
+	} else {
+		var err error
+		if c, path, err = activeContext(config); err != nil {
+			return err
+		}
+
+		if len(args) == 1 && (c == nil || !hasCommand(c, args[0])) {
+			if target, targetPath, err := resolveContext(config, args[0]); err == nil {
+				c, path, args = target, targetPath, nil
+			}
+		}
+
+		if c == nil {
+			return errors.New("no active context, which context should the command run in")
+		}
+	}
+
+	if len(args) == 0 {
+		for _, command := range c.Commands {
+			fmt.Println(command.ID)
+		}
+		return nil
+	}
+
+	for _, command := range c.Commands {
+		if command.ID != args[0] {
+			continue
+		}
+
+		envs, commandArgs, err := ctx.SplitCommand(command.Run)
+		if err != nil {
+			return err
+		}
+
+		if len(commandArgs) == 0 {
+			return fmt.Errorf("command %s has nothing to run", command.ID)
+		}
+
+		return runInContext(config, path, "", 0, false, envs, commandArgs)
+	}
+
+	return withExitCode(exitNotFound, fmt.Errorf("command %s not found in context %s", args[0], path))
+}
+
+// hasCommand reports whether c has a command block called id.
+func hasCommand(c *ctx.Context, id string) bool {
+	for _, command := range c.Commands {
+		if command.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// expandPath expands environment variables and a leading ~ in path.
+func expandPath(path string) (string, error) {
+	path = os.ExpandEnv(path)
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, path[1:]), nil
+}
+
+// selectContext lets the user pick one of the contexts list shows, with fzf
+// opened on query when useFzf is set. Without fzf the contexts containing
+// query are offered in a numbered menu, unless only one does.
+func selectContext(config *ctx.Config, query string, useFzf bool) (string, error) {
+	if _, err := exec.LookPath(fzfCommand); err == nil && useFzf {
+		return executeAndReturn([]string{
+			fzfCommand, "--ansi", "--no-preview", "--query", query,
+		}, append(os.Environ(), fmt.Sprintf("FZF_DEFAULT_COMMAND=%s list", os.Args[0])))
+	}
+
+	parent := config.Contexts
+	if current, _, err := activeContext(config); err != nil {
+		return "", err
+	} else if current != nil {
+		parent = current.SubContexts
+	}
+
+	var candidates []string
+	for _, c := range parent {
+		if !c.IsHidden() && strings.Contains(strings.ToLower(c.ID), strings.ToLower(query)) {
+			candidates = append(candidates, c.ID)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("no context matches %q", query)
+	case 1:
+		return candidates[0], nil
+	}
+
+	for i, id := range candidates {
+		fmt.Fprintf(os.Stderr, "%d) %s\n", i+1, id)
+	}
+	fmt.Fprint(os.Stderr, "context: ")
+
+	var n int
+	if _, err := fmt.Fscanln(os.Stdin, &n); err != nil || n < 1 || n > len(candidates) {
+		return "", errors.New("no context selected")
+	}
+
+	return candidates[n-1], nil
 }
 
-type Context struct {
-	ID           string         `hcl:",label"`
-	Prompt       *string        `hcl:"prompt"`
-	Environments []*Environment `hcl:"env,block"`
-	SubContexts  []*Context     `hcl:"context,block"`
-}
+// handleSet starts a shell in the context addressed by ctxid, in which every
+// ID may be a unique prefix, picked with fzf when empty and useFzf is set.
+// Variables piped in on stdin, in .env format, are added to its environment.
+func handleSet(config *ctx.Config, ctxid, query string, useFzf bool) error {
+	var envs []string
+	var err error
+	if !isTerminal(os.Stdin) {
+		if envs, err = ctx.ParseDotenv(os.Stdin); err != nil {
+			return fmt.Errorf("stdin: %w", err)
+		}
+
+		// stdin is used up, give the shell the terminal when there is one
+		if tty, err := os.Open("/dev/tty"); err == nil {
+			defer tty.Close()
+			os.Stdin = tty
+		}
+	}
+
+	if ctxid == "" {
+		if len(config.Contexts) == 0 {
+			return withExitCode(exitNotFound, errors.New("no contexts defined, add one with ctx add-context <path>"))
+		}
+
+		selected, err := selectContext(config, query, useFzf)
+		if err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+
+		// list prints bare IDs, which may need escaping to form a path
+		ctxid = ctx.JoinPath([]string{selected})
+	}
+
+	c, path, err := findContext(config, ctxid, ctx.FindPrefix)
+	if err != nil {
+		return err
+	}
+
+	if active := os.Getenv(ctx.ActiveEnv); active != "" {
+		if contexts, err := ctx.FindPath(config, active); err == nil {
+			if ctx.ContextPath(contexts) == path {
+				return fmt.Errorf("already in context %s", path)
+			}
+
+			if contexts[len(contexts)-1].ID == c.ID {
+				warnf("entering %s from a context with the same ID", path)
+			}
+		}
+	}
+
+	maxDepth := defaultMaxDepth
+	if config.MaxDepth != nil {
+		maxDepth = *config.MaxDepth
+	}
+
+	if depth := len(ctx.SplitPath(path)); depth > maxDepth {
+		return fmt.Errorf("context %s is nested %d deep, more than max_depth %d", path, depth, maxDepth)
+	}
+
+	return switchContext(config, c, path, envs)
+}
+
+func warnf(format string, args ...interface{}) {
+	prefix := "warning:"
+	if f, ok := ctx.Warnings.(*os.File); ok {
+		prefix = colorize(f, colorYellow, prefix)
+	}
+	fmt.Fprintf(ctx.Warnings, prefix+" "+format+"\n", args...)
+}
+
+// handleUp starts a shell in the parent of the active context, without the
+// variables the active context defines. The new shell runs inside the current
+// one. A top level context has no parent to start, it is left with exit.
+func handleUp(config *ctx.Config) error {
+	active := os.Getenv(ctx.ActiveEnv)
+	if active == "" {
+		return errors.New("no active context")
+	}
+
+	contexts, err := ctx.FindPath(config, active)
+	if err != nil {
+		return withExitCode(exitNotFound, fmt.Errorf("internal error, current context not found: %w", err))
+	}
+
+	if len(contexts) == 1 {
+		return fmt.Errorf("%s is a top level context, leave it with exit", active)
+	}
+
+	// the names the context added are known exactly when ctx started its
+	// shell, otherwise every name the config defines for it is removed
+	names, ok := ctx.ManagedNames()
+	if !ok {
+		names = contexts[len(contexts)-1].EnvironmentNames()
+	}
+	for _, name := range names {
+		os.Unsetenv(name)
+	}
+
+	parents := contexts[:len(contexts)-1]
+	return switchContext(config, parents[len(parents)-1], ctx.ContextPath(parents), nil)
+}
+
+// listNode is a context as printed by list --json-tree.
+type listNode struct {
+	ID       string      `json:"id"`
+	Path     string      `json:"path"`
+	Prompt   string      `json:"prompt,omitempty"`
+	Envs     []listEnv   `json:"envs"`
+	Children []*listNode `json:"children"`
+}
+
+// listEnv is the metadata of an env as printed by list --json-tree. Sources
+// of secret envs are masked.
+type listEnv struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Source string `json:"source,omitempty"`
+	Secret bool   `json:"secret"`
+}
+
+// handleListTree prints the contexts list would show, and everything below
+// them, as a nested JSON array. Sources of secret envs are masked, revealing
+// reveal characters at either end.
+func handleListTree(config *ctx.Config, reveal int) error {
+	var parent = config.Contexts
+	var parentPath []string
+
+	active := os.Getenv(ctx.ActiveEnv)
+	if active != "" {
+		current := ctx.Lookup(config, active)
+		if current == nil {
+			return nil
+		}
+
+		parent = current.SubContexts
+		parentPath = ctx.SplitPath(active)
+	}
+
+	var build func(path []string, contexts []*ctx.Context) []*listNode
+	build = func(path []string, contexts []*ctx.Context) []*listNode {
+		nodes := []*listNode{}
+		for _, c := range contexts {
+			if c.IsHidden() {
+				continue
+			}
+
+			childPath := append(path[:len(path):len(path)], c.ID)
+			node := &listNode{
+				ID:       c.ID,
+				Path:     ctx.JoinPath(childPath),
+				Envs:     []listEnv{},
+				Children: build(childPath, c.SubContexts),
+			}
+			if c.Prompt != nil {
+				node.Prompt = *c.Prompt
+			}
+
+			for _, m := range c.Metadata() {
+				env := listEnv{ID: m.ID, Type: m.Type, Source: m.Source, Secret: m.Secret}
+				if env.Secret && env.Source != "" {
+					env.Source = mask(env.Source, reveal)
+				}
+				node.Envs = append(node.Envs, env)
+			}
+
+			nodes = append(nodes, node)
+		}
+		return nodes
+	}
+
+	out, err := json.MarshalIndent(build(parentPath, parent), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
+
+// handleListActive prints the IDs of the children of the active context, or
+// of the top level contexts outside of one, one per line. Unlike handleList
+// it fails when the active context is gone or there is nothing at all.
+func handleListActive(config *ctx.Config) error {
+	parent := config.Contexts
+	current, _, err := activeContext(config)
+	if err != nil {
+		return err
+	}
+
+	if current != nil {
+		parent = current.SubContexts
+	} else if len(parent) == 0 {
+		return withExitCode(exitNotFound, errors.New("no active context and no contexts defined"))
+	}
+
+	for _, c := range parent {
+		if !c.IsHidden() {
+			fmt.Println(c.ID)
+		}
+	}
+
+	return nil
+}
+
+func handleList(config *ctx.Config, all, paths, sorted, reverse, long bool) error {
+	var parent = config.Contexts
+
+	active := os.Getenv(ctx.ActiveEnv)
+	if active != "" {
+		current := ctx.Lookup(config, active)
+		if current == nil {
+			return nil
+		}
+
+		parent = current.SubContexts
+	}
+
+	// full paths start with / inside a context, so they can be passed back
+	// to set and exec as they are
+	var prefix string
+	if paths && active != "" {
+		prefix = "/" + active + ","
+	}
+
+	var lines []string
+	contexts := make(map[string]*ctx.Context)
+	if !all {
+		for _, c := range parent {
+			if c.IsHidden() {
+				continue
+			}
+
+			line := c.ID
+			if paths {
+				line = prefix + ctx.JoinPath([]string{c.ID})
+			}
+			lines = append(lines, line)
+			contexts[line] = c
+		}
+	} else {
+		err := ctx.Walk(parent, func(path []string, c *ctx.Context) error {
+			if c.IsHidden() {
+				return ctx.SkipContext
+			}
+
+			line := prefix + ctx.JoinPath(path)
+			lines = append(lines, line)
+			contexts[line] = c
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if sorted {
+		sort.Strings(lines)
+	}
+
+	if reverse {
+		for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+			lines[i], lines[j] = lines[j], lines[i]
+		}
+	}
+
+	out, done := pager(len(lines))
+	if long {
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, line := range lines {
+			c := contexts[line]
+			nested := "-"
+			if len(c.SubContexts) > 0 {
+				nested = "+"
+			}
+
+			fmt.Fprintf(w, "%s\t%d env\t%s", line, len(c.Environments), nested)
+			if c.Description != nil && *c.Description != "" {
+				fmt.Fprintf(w, "\t%s", *c.Description)
+			}
+			fmt.Fprintln(w)
+		}
+		w.Flush()
+
+		return done()
+	}
+
+	for _, line := range lines {
+		// contexts with sub contexts are colored, like directories by ls
+		if len(contexts[line].SubContexts) > 0 && out == io.Writer(os.Stdout) {
+			line = colorize(os.Stdout, colorBlue, line)
+		}
+		fmt.Fprintln(out, line)
+	}
+
+	return done()
+}
+
+// handleChanged prints the files watched by the active context that changed
+// since its shell was started, and reports whether there are any.
+func handleChanged(config *ctx.Config) (bool, error) {
+	c, _, err := activeContext(config)
+	if err != nil {
+		return false, err
+	}
+	if c == nil {
+		return false, errors.New("no active context")
+	}
+
+	entered, err := strconv.ParseInt(os.Getenv(ctx.EnteredEnv), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("%s is not set, the shell was not started by ctx set", ctx.EnteredEnv)
+	}
+
+	changed := c.ChangedFiles(time.Unix(0, entered))
+	for _, file := range changed {
+		fmt.Println(file)
+	}
 
-type Config struct {
-	Shell    *string    `hcl:"shell"`
-	Contexts []*Context `hcl:"context,block"`
+	return len(changed) > 0, nil
 }
 
-func lookup(cfg *Config, path string) *Context {
-	if path == "" {
-		return nil
+// handleHelp describes the context at target from its config alone: its
+// description, the names and types of its envs, its commands and its sub
+// contexts. Nothing is resolved.
+func handleHelp(config *ctx.Config, target string) error {
+	c, path, err := resolveContext(config, target)
+	if err != nil {
+		return err
 	}
 
-	var current *Context
-	parts := strings.Split(path, ",")
-	parent := cfg.Contexts
-
-	for _, p := range parts {
+	fmt.Println(path)
+	if c.Description != nil && *c.Description != "" {
+		fmt.Println("  " + *c.Description)
+	}
 
-		found := false
-		for _, c := range parent {
-			if p == c.ID {
-				parent = c.SubContexts
-				current = c
-				found = true
-				break
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if metadata := c.Metadata(); len(metadata) > 0 {
+		fmt.Fprintln(w, "\nenvs")
+		for _, m := range metadata {
+			fmt.Fprintf(w, "  %s\t%s", m.Name, m.Type)
+			if m.Secret {
+				fmt.Fprint(w, "\tsecret")
 			}
+			fmt.Fprintln(w)
 		}
+	}
 
-		if !found {
-			return nil
+	if len(c.Commands) > 0 {
+		fmt.Fprintln(w, "\ncommands")
+		for _, command := range c.Commands {
+			fmt.Fprintf(w, "  %s\t%s\n", command.ID, command.Run)
+		}
+	}
+
+	var children []*ctx.Context
+	for _, child := range c.SubContexts {
+		if !child.IsHidden() {
+			children = append(children, child)
+		}
+	}
+	if len(children) > 0 {
+		fmt.Fprintln(w, "\ncontexts")
+		for _, child := range children {
+			fmt.Fprintf(w, "  %s", child.ID)
+			if child.Description != nil && *child.Description != "" {
+				fmt.Fprintf(w, "\t%s", *child.Description)
+			}
+			fmt.Fprintln(w)
 		}
 	}
 
-	return current
+	return w.Flush()
 }
 
-func main() {
-	var err error
+// handleFreeze prints a config snapshotting the resolved environments of the
+// context at target and its sub contexts, or of the whole tree when target
+// is empty.
+func handleFreeze(config *ctx.Config, target string, includeSecrets bool) error {
+	contexts := config.Contexts
+	if target != "" {
+		c, _, err := resolveContext(config, target)
+		if err != nil {
+			return err
+		}
+		contexts = []*ctx.Context{c}
+	}
+
+	out, err := ctx.Freeze(contexts, includeSecrets)
+	if err != nil {
+		return withExitCode(exitResolve, err)
+	}
 
-	var configFile string
-	var help bool
-	var command string
-	var restArgs []string
-	var contextId string
+	_, err = os.Stdout.Write(out)
+	return err
+}
 
-	allIsRest := false
-	expectContext := false
-	hideBinArgs := os.Args[1:]
+// handleDump prints configFile as is, or config as JSON when format is json.
+// With merged set config is printed as HCL instead of configFile.
+func handleDump(config *ctx.Config, configFile, format string, merged bool) error {
+	switch format {
+	case "", "hcl":
+		if merged {
+			out, err := ctx.EncodeConfig(config)
+			if err != nil {
+				return err
+			}
 
-	for i := 0; i < len(hideBinArgs); i++ {
-		if help {
-			break
+			_, err = os.Stdout.Write(out)
+			return err
 		}
 
-		if allIsRest {
-			restArgs = append(restArgs, hideBinArgs[i])
-			continue
+		file, err := ctx.MainConfigFile(configFile)
+		if err != nil {
+			return withExitCode(exitConfig, err)
 		}
 
-		if expectContext {
-			contextId = hideBinArgs[i]
-			expectContext = false
-			continue
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			return withExitCode(exitConfig, err)
 		}
 
-		switch hideBinArgs[i] {
-		case "-config", "--config":
-			i++
-			configFile = hideBinArgs[i]
-		case "--":
-			allIsRest = true
-		case "-help", "--help":
-			help = true
-		case "set", "exec":
-			expectContext = true
-			fallthrough
-		case "prompt", "list", "dump", "edit":
-			if command == "" {
-				command = hideBinArgs[i]
-				continue
-			}
-			fallthrough
-		default:
-			restArgs = append(restArgs, hideBinArgs[i])
+		fmt.Println(string(buf))
+	case "json":
+		out, err := json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			return err
 		}
-	}
 
-	if help {
-		fmt.Println("usage: ctx [set <argment> | prompt | list | edit | dump | help]")
-		fmt.Println()
-		fmt.Println("  if", fzfCommand, "is installed, no argument is need to set context")
-		fmt.Println()
-		os.Exit(0)
+		fmt.Println(string(out))
+	default:
+		return fmt.Errorf("unknown dump format: %s", format)
 	}
 
-	if configFile == "" {
-		configFile = os.Getenv("CTX_CONFIG")
+	return nil
+}
+
+// handleAddContext adds an empty context at the path args[0] to the config
+// files.
+func handleAddContext(configFile string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("add-context needs the path of the new context")
 	}
 
-	if command == "" {
-		command = "set"
+	path := targetPath(args[0])
+	if err := ctx.AddContext(configFile, path); err != nil {
+		return err
 	}
 
-	var config Config
+	fmt.Printf("added context %s\n", path)
+	return nil
+}
 
-	switch command {
-	case "set":
-		if err = parseConfig(configFile, &config); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		err = handleSet(&config, contextId)
-	case "exec":
-		if err = parseConfig(configFile, &config); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
+// handleAddEnv adds the env args[1] of type typ and source to the context
+// addressed by args[0] in the config files.
+func handleAddEnv(config *ctx.Config, configFile, typ, source string, args []string) error {
+	if len(args) != 2 {
+		return errors.New("add-env needs a context and the ID of the new env")
+	}
 
-		if len(restArgs) == 0 {
-			err = errors.New("what command should execute")
-		} else {
-			err = handleExec(&config, contextId, restArgs)
-		}
-	case "prompt":
-		if err = parseConfig(configFile, &config); err != nil {
-			os.Exit(0)
-		}
+	_, path, err := resolveContext(config, args[0])
+	if err != nil {
+		return err
+	}
 
-		err = nil
-		handlePrompt(&config)
-	case "list":
-		if err = parseConfig(configFile, &config); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
+	if err := ctx.AddEnvironment(configFile, path, args[1], typ, source); err != nil {
+		return err
+	}
 
-		err = nil
-		handleList(&config)
-	case "dump":
-		if err = parseConfig(configFile, &config); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
+	fmt.Printf("added env %s to context %s\n", args[1], path)
+	return nil
+}
 
-		var buf []byte
-		if buf, err = os.ReadFile(configFile); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
+// handleRename renames the context addressed by args[0] to args[1] in the
+// config files.
+func handleRename(config *ctx.Config, configFile string, args []string) error {
+	if len(args) != 2 {
+		return errors.New("rename needs a context and its new ID")
+	}
 
-		fmt.Println(string(buf))
-	case "edit":
-		if err = parseConfig(configFile, &config); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
+	_, path, err := resolveContext(config, args[0])
+	if err != nil {
+		return err
+	}
 
-		err = handleEdit(configFile)
+	if err := ctx.RenameContext(configFile, path, args[1]); err != nil {
+		return err
 	}
 
+	fmt.Printf("renamed %s to %s\n", path, args[1])
+	return nil
+}
+
+func handleEdit(configFile string) error {
+	file, err := ctx.MainConfigFile(configFile)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
 
-	os.Exit(0)
+	editorCommand := os.Getenv("EDITOR")
+	return execute([]string{editorCommand, file}, os.Environ())
 }
 
-func handleExec(config *Config, ctxid string, args []string) error {
-	var parent = config.Contexts
+// handleGraph prints the whole context tree as a Graphviz digraph. Nodes are
+// named by their full path so identical IDs under different parents stay
+// distinct.
+func handleGraph(config *ctx.Config, envCount bool) error {
+	fmt.Println("digraph ctx {")
 
-	active := os.Getenv(ctxActiveEnv)
-	if active != "" {
-		ctx := lookup(config, active)
-		if ctx == nil {
-			return errors.New("internal error, current context not found")
+	err := ctx.Walk(config.Contexts, func(path []string, c *ctx.Context) error {
+		if c.IsHidden() {
+			return ctx.SkipContext
 		}
 
-		parent = ctx.SubContexts
-	}
-
-	for _, c := range parent {
-		if c.ID == ctxid {
-			environmentVariables, err := generateEnvironment(c, []string{})
-			if err != nil {
-				return err
-			}
+		node := ctx.JoinPath(path)
+		label := c.ID
+		if envCount {
+			label = fmt.Sprintf("%s\n%d env", c.ID, len(c.Environments))
+		}
+		fmt.Printf("\t%q [label=%q];\n", node, label)
 
-			cmd := exec.Command(args[0], args[1:]...)
-			cmd.Env = environmentVariables
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			return cmd.Run()
+		if len(path) > 1 {
+			fmt.Printf("\t%q -> %q;\n", ctx.JoinPath(path[:len(path)-1]), node)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("context %s not found", ctxid)
+	fmt.Println("}")
+	return nil
 }
 
-func handleSet(config *Config, ctxid string) error {
-	if ctxid == "" {
-		var err error
-		ctxid, err = executeAndReturn([]string{
-			fzfCommand, "--ansi", "--no-preview",
-		}, append(os.Environ(), fmt.Sprintf("FZF_DEFAULT_COMMAND=%s list", os.Args[0])))
+// handleClearCache removes the whole cache directory, or with args the cached
+// values of the context at args[0], optionally only of its env args[1].
+func handleClearCache(config *ctx.Config, args []string) error {
+	if len(args) == 0 {
+		dir, err := ctx.CacheDir()
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			return err
 		}
-	}
 
-	var parent = config.Contexts
+		if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+			fmt.Println("cache is empty")
+			return nil
+		}
 
-	active := os.Getenv(ctxActiveEnv)
-	if active != "" {
-		ctx := lookup(config, active)
-		if ctx == nil {
-			return errors.New("internal error, current context not found")
+		if err := os.RemoveAll(dir); err != nil {
+			return err
 		}
 
-		parent = ctx.SubContexts
+		fmt.Println("cleared", dir)
+		return nil
 	}
 
-	for _, c := range parent {
-		if c.ID == ctxid {
-			return switchContext(config, c)
-		}
+	c, path, err := resolveContext(config, args[0])
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("context %s not found", ctxid)
-}
+	cleared := 0
+	for _, e := range c.Environments {
+		if e.Cache == nil || len(args) > 1 && e.ID != args[1] {
+			continue
+		}
 
-func handlePrompt(config *Config) {
-	active := os.Getenv(ctxActiveEnv)
-	if active == "" {
-		return
-	}
+		// an env with sources caches the value of every source on its own
+		removed := false
+		for _, part := range e.Parts() {
+			file, err := ctx.CacheFile(part)
+			if err != nil {
+				return err
+			}
 
-	c := lookup(config, active)
-	if c == nil {
-		return
+			if err := os.Remove(file); errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			removed = true
+		}
+
+		if removed {
+			fmt.Printf("cleared %s env %s\n", path, e.ID)
+			cleared++
+		}
 	}
 
-	if c.Prompt != nil {
-		fmt.Print(*c.Prompt)
+	if cleared == 0 {
+		fmt.Println("nothing cached for", strings.Join(append([]string{path}, args[1:]...), " "))
 	}
-}
 
-func handleList(config *Config) {
-	var parent = config.Contexts
+	return nil
+}
 
-	active := os.Getenv(ctxActiveEnv)
-	if active != "" {
-		ctx := lookup(config, active)
-		if ctx == nil {
-			return
+func handleDoctor(configFile string) error {
+	failed := false
+	report := func(ok, critical bool, format string, args ...interface{}) {
+		status, color := "ok", colorGreen
+		if !ok {
+			status, color = "warn", colorYellow
+			if critical {
+				status, color = "fail", colorRed
+				failed = true
+			}
 		}
+		fmt.Printf("[%s] %s\n", colorize(os.Stdout, color, status), fmt.Sprintf(format, args...))
+	}
 
-		parent = ctx.SubContexts
+	if path, err := exec.LookPath(fzfCommand); err != nil {
+		report(false, false, "%s not found on PATH, set needs an explicit context", fzfCommand)
+	} else {
+		report(true, false, "%s found at %s", fzfCommand, path)
 	}
 
-	for _, c := range parent {
-		fmt.Println(c.ID)
+	if editor := os.Getenv("EDITOR"); editor == "" {
+		report(false, false, "EDITOR is not set, edit will not work")
+	} else if path, err := exec.LookPath(editor); err != nil {
+		report(false, false, "EDITOR %s not found on PATH", editor)
+	} else {
+		report(true, false, "EDITOR found at %s", path)
 	}
-}
 
-func handleEdit(configFile string) error {
-	editorCommand := os.Getenv("EDITOR")
-	return execute([]string{editorCommand, configFile}, os.Environ())
-}
+	var config ctx.Config
+	if err := ctx.ParseConfig(configFile, &config); err != nil {
+		report(false, true, "config does not parse: %s", err)
+		return errors.New("doctor found problems")
+	}
+	report(true, true, "config parses")
 
-func generateEnvironment(context *Context, additionalEnvs []string) ([]string, error) {
-	var environmentVariables []string
-	environmentVariables = append(environmentVariables, os.Environ()...)
-	for _, e := range context.Environments {
-		val, err := resolveEnvironment(e)
-		if err != nil {
-			return nil, err
+	if _, _, path, err := lookShell(&config); err != nil {
+		report(false, true, "%s", err)
+	} else {
+		report(true, true, "shell found at %s", path)
+	}
+
+	err := ctx.Walk(config.Contexts, func(path []string, c *ctx.Context) error {
+		for _, e := range c.Environments {
+			if e.Type == nil || *e.Type != "file" {
+				continue
+			}
+
+			for _, part := range e.Parts() {
+				if _, err := os.Stat(part.SourcePath()); err != nil {
+					report(false, true, "context %s env %s: %s", ctx.JoinPath(path), e.ID, err)
+				}
+			}
 		}
-		environmentVariables = append(environmentVariables, fmt.Sprintf("%s=%s", e.ID, val))
+		return nil
+	})
+	if err != nil {
+		report(false, true, "%s", err)
 	}
-	environmentVariables = append(environmentVariables, additionalEnvs...)
 
-	active := os.Getenv("CTX_ACTIVE")
-	if active != "" {
-		environmentVariables = append(environmentVariables,
-			fmt.Sprintf("CTX_ACTIVE=%s,%s", active, context.ID))
-	} else {
-		environmentVariables = append(environmentVariables,
-			fmt.Sprintf("CTX_ACTIVE=%s", context.ID))
+	if failed {
+		return errors.New("doctor found problems")
 	}
 
-	return environmentVariables, nil
+	return nil
 }
 
-func switchContext(config *Config, context *Context) error {
+// detectShell returns the shell command configured in config, falling back to
+// $SHELL.
+func detectShell(config *ctx.Config) string {
 	var shell string
 
 	if config.Shell != nil {
@@ -337,26 +1400,148 @@ func switchContext(config *Config, context *Context) error {
 		shell = os.Getenv("SHELL")
 	}
 
+	return shell
+}
+
+// shellCommand returns the shell switchContext starts: shell_args as they
+// are, or the shell detectShell finds split by ctx.SplitCommand.
+func shellCommand(config *ctx.Config) (envs, args []string, err error) {
+	if len(config.ShellArgs) > 0 {
+		return nil, config.ShellArgs, nil
+	}
+
+	shell := detectShell(config)
 	if shell == "" {
-		return errors.New("can not detect current shell")
+		return nil, nil, errors.New("can not detect current shell")
+	}
+
+	if envs, args, err = ctx.SplitCommand(shell); err != nil {
+		return nil, nil, fmt.Errorf("shell %s does not parse: %w", shell, err)
+	}
+
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("shell %q is empty", shell)
+	}
+
+	return envs, args, nil
+}
+
+// lookShell checks that the shell shellCommand returns can be started and
+// returns where it was found.
+func lookShell(config *ctx.Config) (envs, args []string, path string, err error) {
+	if envs, args, err = shellCommand(config); err != nil {
+		return nil, nil, "", err
+	}
+
+	if path, err = exec.LookPath(args[0]); err != nil {
+		return nil, nil, "", fmt.Errorf("shell %s not found on PATH", args[0])
 	}
 
-	envs, args, err := shellwords.ParseWithEnvs(*config.Shell)
+	return envs, args, path, nil
+}
+
+// switchContext starts a shell in context, in its cwd when it sets one. A nil
+// context starts a shell outside of any context.
+func switchContext(config *ctx.Config, context *ctx.Context, path string, extraEnvs []string) error {
+	envs, args, _, err := lookShell(config)
 	if err != nil {
 		return err
 	}
 
-	environmentVariables, err := generateEnvironment(context, envs)
+	envs = append(envs, extraEnvs...)
+
+	dir, err := contextDir(context)
 	if err != nil {
 		return err
 	}
 
+	var environmentVariables []string
+	if context == nil {
+		environmentVariables = append(os.Environ(), envs...)
+	} else if environmentVariables, err = ctx.GenerateEnvironment(config, path,
+		append(envs, fmt.Sprintf("%s=%d", ctx.EnteredEnv, time.Now().UnixNano()))); err != nil {
+		return withExitCode(exitResolve, err)
+	} else {
+		recordHistory(path)
+	}
+
 	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
 	cmd.Env = environmentVariables
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+
+	// ctx stays alive until the shell is gone, however it ends, so the
+	// on_exit hook always runs. Signals sent to ctx are passed on.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer runExitHook(context, environmentVariables)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return cmd.Wait()
+}
+
+// contextDir returns the cwd of context with ~ and environment variables
+// expanded, or an empty string for the current directory when it sets none.
+func contextDir(context *ctx.Context) (string, error) {
+	if context == nil || context.Cwd == nil || *context.Cwd == "" {
+		return "", nil
+	}
+
+	dir, err := expandPath(*context.Cwd)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("cwd of context %s: %w", context.ID, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("cwd of context %s: %s is not a directory", context.ID, dir)
+	}
+
+	return dir, nil
+}
+
+// runExitHook runs the on_exit command of context, if it has one, in the
+// environment the shell of context had. A failing hook is only a warning.
+func runExitHook(context *ctx.Context, envs []string) {
+	if context == nil || context.OnExit == nil || *context.OnExit == "" {
+		return
+	}
+
+	hookEnvs, args, err := ctx.SplitCommand(*context.OnExit)
+	if err != nil {
+		warnf("on_exit of context %s does not parse: %s", context.ID, err)
+		return
+	}
+
+	if len(args) == 0 {
+		return
+	}
+
+	if err := execute(args, append(envs, hookEnvs...)); err != nil {
+		warnf("on_exit of context %s failed: %s", context.ID, err)
+	}
 }
 
 func executeAndReturn(args, envs []string) (string, error) {
@@ -384,62 +1569,3 @@ func execute(args, envs []string) error {
 	cmd.Env = envs
 	return cmd.Run()
 }
-
-func resolveEnvironment(e *Environment) (string, error) {
-	var resolveType string
-	if e.Type == nil {
-		resolveType = "static"
-	} else {
-		resolveType = *e.Type
-	}
-
-	switch resolveType {
-	case "static":
-		return e.Source, nil
-	case "file":
-		content, err := os.ReadFile(e.Source)
-		if err != nil {
-			return "", err
-		}
-		return string(content), nil
-	case "command":
-		envs, args, err := shellwords.ParseWithEnvs(e.Source)
-		if err != nil {
-			return "", err
-		}
-		content, err := executeAndReturn(args, append(os.Environ(), envs...))
-		if err != nil {
-			return "", err
-		}
-		return content, nil
-	default:
-		return "", fmt.Errorf("unknown environment resolution type: %s", resolveType)
-	}
-}
-
-func parseConfig(configFile string, config *Config) error {
-	if configFile == "" {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return err
-		}
-		configFile = filepath.Join(home, ".ctx.hcl")
-	}
-
-	if _, err := os.Stat(configFile); err != nil {
-		return err
-	}
-
-	parser := hclparse.NewParser()
-	f, diag := parser.ParseHCLFile(configFile)
-	if diag != nil && diag.HasErrors() {
-		return diag
-	}
-
-	diag = gohcl.DecodeBody(f.Body, nil, config)
-	if diag != nil && diag.HasErrors() {
-		return diag
-	}
-
-	return nil
-}
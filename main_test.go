@@ -0,0 +1,548 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ctxBinary is the ctx binary TestMain builds for the tests to run.
+var ctxBinary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "ctx-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ctxBinary = filepath.Join(dir, "ctx")
+	build := exec.Command("go", "build", "-o", ctxBinary, ".")
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "building ctx:", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+const testConfig = `
+context "prod" {
+  env "GREETING" {
+    source = "hello prod"
+  }
+
+  context "web" {
+    env "PORT" {
+      source = "8080"
+    }
+  }
+}
+
+context "dev" {
+  env "GREETING" {
+    source = "hello dev"
+  }
+}
+`
+
+// testShims are put on PATH in place of the programs ctx starts. The shell
+// prints the environment it was started in, fzf picks $FZF_PICK and the
+// editor prints the file it was asked to open.
+var testShims = map[string]string{
+	"shell":  `echo "shell $CTX_ACTIVE $GREETING $PORT"`,
+	"fzf":    `echo "$FZF_PICK"`,
+	"editor": `echo "edit $1"`,
+}
+
+// harness is a HOME with a config and a PATH with the shims, isolated from
+// the environment of the test.
+type harness struct {
+	t    *testing.T
+	home string
+	bin  string
+	env  []string
+}
+
+func newHarness(t *testing.T, config string) *harness {
+	t.Helper()
+
+	h := &harness{t: t, home: t.TempDir(), bin: t.TempDir()}
+	if err := os.WriteFile(filepath.Join(h.home, ".ctx.hcl"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, script := range testShims {
+		if err := os.WriteFile(filepath.Join(h.bin, name), []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h.env = []string{
+		"PATH=" + h.bin + string(os.PathListSeparator) + "/usr/bin" + string(os.PathListSeparator) + "/bin",
+		"HOME=" + h.home,
+		"CTX_CONFIG=" + filepath.Join(h.home, ".ctx.hcl"),
+		"XDG_CACHE_HOME=" + filepath.Join(h.home, ".cache"),
+		"SHELL=" + filepath.Join(h.bin, "shell"),
+		"EDITOR=" + filepath.Join(h.bin, "editor"),
+		"TERM=dumb",
+		"NO_COLOR=1",
+	}
+
+	return h
+}
+
+// run runs ctx with args and the extra environment variables envs, and
+// returns its stdout, stderr and exit code.
+func (h *harness) run(envs []string, args ...string) (string, string, int) {
+	h.t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(ctxBinary, args...)
+	cmd.Dir = h.home
+	cmd.Env = append(append([]string{}, h.env...), envs...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		h.t.Fatalf("running ctx %s: %v", strings.Join(args, " "), err)
+	}
+
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+func TestSet(t *testing.T) {
+	h := newHarness(t, testConfig)
+
+	tests := []struct {
+		name   string
+		envs   []string
+		args   []string
+		stdout string
+		errors string
+		code   int
+	}{
+		{
+			name:   "context",
+			args:   []string{"set", "prod"},
+			stdout: "shell prod hello prod \n",
+		},
+		{
+			name:   "nested path",
+			args:   []string{"set", "prod,web"},
+			stdout: "shell prod,web hello prod 8080\n",
+		},
+		{
+			name:   "prefix",
+			args:   []string{"set", "de"},
+			stdout: "shell dev hello dev \n",
+		},
+		{
+			name:   "relative to the active context",
+			envs:   []string{"CTX_ACTIVE=prod", "GREETING=hello prod", "CTX_MANAGED_VARS=GREETING"},
+			args:   []string{"set", "web"},
+			stdout: "shell prod,web hello prod 8080\n",
+		},
+		{
+			name:   "jump drops the variables of the active context",
+			envs:   []string{"CTX_ACTIVE=prod,web", "GREETING=hello prod", "PORT=8080", "CTX_MANAGED_VARS=GREETING,PORT"},
+			args:   []string{"set", "/dev"},
+			stdout: "shell dev hello dev \n",
+		},
+		{
+			name:   "picked with fzf",
+			envs:   []string{"FZF_PICK=dev"},
+			args:   []string{"set"},
+			stdout: "shell dev hello dev \n",
+		},
+		{
+			name:   "not found",
+			args:   []string{"set", "staging"},
+			errors: "context staging not found",
+			code:   exitNotFound,
+		},
+		{
+			name:   "already active",
+			envs:   []string{"CTX_ACTIVE=prod"},
+			args:   []string{"set", "/prod"},
+			errors: "already in context prod",
+			code:   exitFailure,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stdout, stderr, code := h.run(test.envs, test.args...)
+			if code != test.code {
+				t.Fatalf("exit code = %d, want %d, stderr: %s", code, test.code, stderr)
+			}
+			if test.errors == "" && stdout != test.stdout {
+				t.Errorf("stdout = %q, want %q", stdout, test.stdout)
+			}
+			// errors are printed on stdout
+			if test.errors != "" && !strings.Contains(stdout, test.errors) {
+				t.Errorf("stdout = %q, want it to contain %q", stdout, test.errors)
+			}
+		})
+	}
+}
+
+func TestSetEmptyConfig(t *testing.T) {
+	for _, config := range []string{"", "# no contexts yet\n"} {
+		h := newHarness(t, config)
+
+		stdout, _, code := h.run([]string{"FZF_PICK=prod"}, "set")
+		if code != exitNotFound {
+			t.Errorf("exit code = %d, want %d", code, exitNotFound)
+		}
+		if !strings.Contains(stdout, "no contexts defined") {
+			t.Errorf("stdout = %q, want it to say no contexts are defined", stdout)
+		}
+		if strings.Contains(stdout, "shell") {
+			t.Errorf("stdout = %q, want no shell started", stdout)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	h := newHarness(t, testConfig)
+
+	stdout, stderr, code := h.run(nil, "list")
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr)
+	}
+	if stdout != "prod\ndev\n" {
+		t.Errorf("list = %q, want the top level contexts", stdout)
+	}
+
+	stdout, _, _ = h.run([]string{"CTX_ACTIVE=prod"}, "list")
+	if stdout != "web\n" {
+		t.Errorf("list in prod = %q, want its subcontexts", stdout)
+	}
+
+	stdout, _, _ = h.run(nil, "list", "--paths")
+	if stdout != "prod\ndev\n" {
+		t.Errorf("list --paths = %q, want the top level paths", stdout)
+	}
+
+	stdout, _, _ = h.run([]string{"CTX_ACTIVE=prod"}, "list", "--paths")
+	if stdout != "/prod,web\n" {
+		t.Errorf("list --paths in prod = %q, want paths from the top", stdout)
+	}
+}
+
+func TestExec(t *testing.T) {
+	h := newHarness(t, testConfig)
+
+	stdout, stderr, code := h.run(nil, "exec", "prod,web", "--", "sh", "-c", `echo "$GREETING:$PORT:$CTX_ACTIVE"`)
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr)
+	}
+	if stdout != "hello prod:8080:prod,web\n" {
+		t.Errorf("stdout = %q, want the envs of prod and web", stdout)
+	}
+
+	if _, _, code := h.run(nil, "exec", "dev", "--", "sh", "-c", "exit 7"); code != 7 {
+		t.Errorf("exit code = %d, want the exit code of the command", code)
+	}
+
+	if _, _, code := h.run(nil, "exec", "staging", "--", "true"); code != exitNotFound {
+		t.Errorf("exit code = %d, want %d for an unknown context", code, exitNotFound)
+	}
+}
+
+func TestDump(t *testing.T) {
+	h := newHarness(t, testConfig)
+
+	stdout, stderr, code := h.run(nil, "dump")
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr)
+	}
+	for _, want := range []string{`context "prod"`, `context "web"`, `context "dev"`, `"hello dev"`} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("dump does not contain %s:\n%s", want, stdout)
+		}
+	}
+
+	if _, _, code := newHarness(t, `context "broken" {`).run(nil, "dump"); code != exitConfig {
+		t.Errorf("exit code = %d, want %d for a config that does not parse", code, exitConfig)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	h := newHarness(t, testConfig)
+
+	stdout, stderr, code := h.run(nil, "edit")
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr)
+	}
+	if want := "edit " + filepath.Join(h.home, ".ctx.hcl") + "\n"; stdout != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+}
+
+func TestDo(t *testing.T) {
+	h := newHarness(t, `
+context "prod" {
+  env "GREETING" {
+    source = "hello prod"
+  }
+
+  command "greet" {
+    run = "sh -c 'echo $GREETING'"
+  }
+
+  context "web" {
+    command "deploy" {
+      run = "echo deploying"
+    }
+  }
+}
+`)
+
+	tests := []struct {
+		name   string
+		envs   []string
+		args   []string
+		stdout string
+		code   int
+	}{
+		{name: "list the active context", envs: []string{"CTX_ACTIVE=prod"}, args: []string{"do"}, stdout: "greet\n"},
+		{name: "command of the active context", envs: []string{"CTX_ACTIVE=prod"}, args: []string{"do", "greet"}, stdout: "hello prod\n"},
+		{name: "list a context", args: []string{"do", "prod,web"}, stdout: "deploy\n"},
+		{name: "list a context below the active one", envs: []string{"CTX_ACTIVE=prod"}, args: []string{"do", "web"}, stdout: "deploy\n"},
+		{name: "context and command", args: []string{"do", "prod,web", "deploy"}, stdout: "deploying\n"},
+		{name: "unknown command", envs: []string{"CTX_ACTIVE=prod"}, args: []string{"do", "nope"}, code: exitNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stdout, stderr, code := h.run(test.envs, test.args...)
+			if code != test.code {
+				t.Fatalf("exit code = %d, want %d, stdout: %s, stderr: %s", code, test.code, stdout, stderr)
+			}
+			if test.code == 0 && stdout != test.stdout {
+				t.Errorf("stdout = %q, want %q", stdout, test.stdout)
+			}
+		})
+	}
+}
+
+func TestHelp(t *testing.T) {
+	h := newHarness(t, testConfig+`
+context "list" {
+  description = "a context called like a command"
+}
+`)
+
+	tests := []struct {
+		name   string
+		config bool
+		args   []string
+		want   string
+	}{
+		{name: "context", config: true, args: []string{"help", "prod"}, want: "prod\n"},
+		{name: "command", config: true, args: []string{"help", "exec"}, want: "usage: ctx exec"},
+		{name: "command prefix", config: true, args: []string{"help", "fre"}, want: "usage: ctx freeze"},
+		{name: "context wins over command", config: true, args: []string{"help", "list"}, want: "a context called like a command"},
+		{name: "command without a config", args: []string{"help", "exec"}, want: "usage: ctx exec"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envs := []string{"CTX_CONFIG=" + filepath.Join(h.home, ".ctx.hcl")}
+			if !test.config {
+				envs = []string{"CTX_CONFIG=" + filepath.Join(h.home, "missing.hcl")}
+			}
+
+			stdout, stderr, code := h.run(envs, test.args...)
+			if code != 0 {
+				t.Fatalf("exit code = %d, stdout: %s, stderr: %s", code, stdout, stderr)
+			}
+			if !strings.Contains(stdout, test.want) {
+				t.Errorf("stdout = %q, want it to contain %q", stdout, test.want)
+			}
+		})
+	}
+
+	if _, _, code := h.run(nil, "help", "staging"); code != exitNotFound {
+		t.Errorf("exit code = %d, want %d for an unknown context", code, exitNotFound)
+	}
+}
+
+func TestRun(t *testing.T) {
+	h := newHarness(t, testConfig)
+
+	stdout, stderr, code := h.run([]string{"GREETING=old"}, "run", "prod", "--", "sh", "-c", "env | grep -E '^(GREETING|CTX_ACTIVE)='")
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr)
+	}
+	if stdout != "GREETING=hello prod\nCTX_ACTIVE=prod\n" {
+		t.Errorf("stdout = %q, want a single value for every variable", stdout)
+	}
+}
+
+func TestExecCommandStdin(t *testing.T) {
+	h := newHarness(t, `
+context "p" {
+  env "PASS" {
+    type   = "command"
+    source = "sh -c 'read v; echo got:$v'"
+  }
+
+  env "USER_NAME" {
+    type   = "command"
+    source = "echo someone"
+  }
+
+  env "REGION" {
+    source = "eu"
+  }
+}
+`)
+
+	cmd := exec.Command(ctxBinary, "--parallel", "4", "exec", "p", "--", "sh", "-c", "echo $PASS $USER_NAME $REGION")
+	cmd.Dir = h.home
+	cmd.Env = h.env
+	cmd.Stdin = strings.NewReader("secret\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	if string(out) != "got:secret someone eu\n" {
+		t.Errorf("stdout = %q, want the command to read stdin while envs resolve concurrently", out)
+	}
+}
+
+func TestActiveFlag(t *testing.T) {
+	h := newHarness(t, testConfig)
+
+	for _, envs := range [][]string{
+		nil,
+		{"CTX_ACTIVE=dev", "GREETING=hello dev", "CTX_MANAGED_VARS=GREETING"},
+	} {
+		stdout, stderr, code := h.run(envs, "-C", "prod", "exec", "web", "--", "sh", "-c", `echo "$GREETING:$PORT:$CTX_ACTIVE"`)
+		if code != 0 {
+			t.Fatalf("exit code = %d, stderr: %s", code, stderr)
+		}
+		if stdout != "hello prod:8080:prod,web\n" {
+			t.Errorf("with %q: stdout = %q, want the envs of prod and web", envs, stdout)
+		}
+	}
+}
+
+func TestHistorySurvivesClearCache(t *testing.T) {
+	h := newHarness(t, testConfig)
+
+	if _, stderr, code := h.run(nil, "set", "prod"); code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr)
+	}
+	if _, stderr, code := h.run(nil, "clear-cache"); code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr)
+	}
+
+	stdout, _, _ := h.run(nil, "history")
+	if !strings.Contains(stdout, "prod") {
+		t.Errorf("history = %q, want prod still in it", stdout)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	h := newHarness(t, testConfig)
+
+	tests := []struct {
+		name   string
+		envs   []string
+		args   []string
+		stdout string
+	}{
+		{
+			name:   "every context on the path",
+			args:   []string{"merge", "dev", "prod,web"},
+			stdout: "hello prod:8080:prod,web\n",
+		},
+		{
+			name:   "later contexts win",
+			args:   []string{"merge", "prod,web", "dev"},
+			stdout: "hello dev:8080:dev\n",
+		},
+		{
+			name:   "the variables of the active context are dropped",
+			envs:   []string{"CTX_ACTIVE=prod,web", "GREETING=hello prod", "PORT=8080", "CTX_MANAGED_VARS=GREETING,PORT"},
+			args:   []string{"merge", "/prod", "/dev"},
+			stdout: "hello dev::dev\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := append(test.args, "--", "sh", "-c", `echo "$GREETING:$PORT:$CTX_ACTIVE"`)
+			stdout, stderr, code := h.run(test.envs, args...)
+			if code != 0 {
+				t.Fatalf("exit code = %d, stdout: %s, stderr: %s", code, stdout, stderr)
+			}
+			if stdout != test.stdout {
+				t.Errorf("stdout = %q, want %q", stdout, test.stdout)
+			}
+		})
+	}
+}
+
+func TestUp(t *testing.T) {
+	h := newHarness(t, testConfig)
+
+	stdout, stderr, code := h.run([]string{"CTX_ACTIVE=prod,web", "GREETING=hello prod", "PORT=8080", "CTX_MANAGED_VARS=GREETING,PORT"}, "up")
+	if code != 0 {
+		t.Fatalf("exit code = %d, stdout: %s, stderr: %s", code, stdout, stderr)
+	}
+	if stdout != "shell prod hello prod \n" {
+		t.Errorf("stdout = %q, want a shell in prod", stdout)
+	}
+
+	stdout, _, code = h.run([]string{"CTX_ACTIVE=prod", "GREETING=hello prod", "CTX_MANAGED_VARS=GREETING"}, "up")
+	if code != exitFailure || strings.Contains(stdout, "shell") {
+		t.Errorf("exit code = %d, stdout = %q, want up to refuse at the top level", code, stdout)
+	}
+	if !strings.Contains(stdout, "leave it with exit") {
+		t.Errorf("stdout = %q, want it to point to exit", stdout)
+	}
+}
+
+func TestClearCacheContext(t *testing.T) {
+	h := newHarness(t, `
+context "prod" {
+  context "web" {
+    env "TOKEN" {
+      type   = "command"
+      source = "echo token"
+      cache  = "5m"
+    }
+  }
+}
+`)
+
+	if _, stderr, code := h.run(nil, "exec", "prod,web", "--", "true"); code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr)
+	}
+
+	stdout, stderr, code := h.run([]string{"CTX_ACTIVE=prod"}, "clear-cache", "web")
+	if code != 0 {
+		t.Fatalf("exit code = %d, stdout: %s, stderr: %s", code, stdout, stderr)
+	}
+	if stdout != "cleared prod,web env TOKEN\n" {
+		t.Errorf("stdout = %q, want web resolved below the active context", stdout)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ANSI colors of human output.
+const (
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+	colorBlue   = "34"
+)
+
+// useColor reports whether output to f may be colored: f is a terminal and
+// colorAllowed. Output read by programs, such as prompt, JSON and the list fzf
+// reads, is never colored.
+func useColor(f *os.File) bool {
+	return colorAllowed() && isTerminal(f)
+}
+
+// colorAllowed reports whether NO_COLOR is not set and TERM is not dumb.
+func colorAllowed() bool {
+	return os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+}
+
+// colorize wraps s in color when output to f may be colored.
+func colorize(f *os.File, color, s string) string {
+	if !useColor(f) {
+		return s
+	}
+
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// printError prints err for the user on stdout.
+func printError(err error) {
+	fmt.Println(colorize(os.Stdout, colorRed, err.Error()))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/sgx79/ctxcli/ctx"
+)
+
+const defaultPager = "less"
+
+// isTerminal reports whether f is a terminal rather than a pipe or a file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalHeight returns the number of rows of the terminal on stdout, taken
+// from $LINES when set. Zero is returned when it is unknown.
+func terminalHeight() int {
+	if lines, err := strconv.Atoi(os.Getenv("LINES")); err == nil && lines > 0 {
+		return lines
+	}
+
+	return windowHeight(os.Stdout)
+}
+
+// pager returns the writer output of lines lines should go to, and a function
+// to call once everything is written. The output goes through $PAGER, or less,
+// when stdout is a terminal that is too small for it and fzf is not there to
+// browse it. Otherwise, or when the pager does not start, it goes to stdout.
+func pager(lines int) (io.Writer, func() error) {
+	stdout := func() error { return nil }
+
+	if !isTerminal(os.Stdout) {
+		return os.Stdout, stdout
+	}
+
+	if height := terminalHeight(); height == 0 || lines < height {
+		return os.Stdout, stdout
+	}
+
+	if _, err := exec.LookPath(fzfCommand); err == nil {
+		return os.Stdout, stdout
+	}
+
+	command := os.Getenv("PAGER")
+	if command == "" {
+		command = defaultPager
+	}
+
+	_, args, err := ctx.SplitCommand(command)
+	if err != nil || len(args) == 0 {
+		return os.Stdout, stdout
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return os.Stdout, stdout
+	}
+
+	if err := cmd.Start(); err != nil {
+		return os.Stdout, stdout
+	}
+
+	return in, func() error {
+		in.Close()
+		return cmd.Wait()
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sgx79/ctxcli/ctx"
+)
+
+// handlePrompt prints the prompt of the context at path, a full path that
+// defaults to the active context, for side, empty for the plain prompt. A
+// non-negative exitStatus puts a mark for it in front, and color codes are
+// marked as non-printing the way shell expects them. It runs on every
+// redraw of the shell prompt, so it never resolves an env, which could run a
+// command or reach the network, and the rendered prompt is cached until a
+// config file changes. Nothing is printed when the config can not be read.
+func handlePrompt(configFile, path, side, shell string, exitStatus int) {
+	active := strings.TrimPrefix(path, "/")
+	if active == "" {
+		active = os.Getenv(ctx.ActiveEnv)
+	}
+	if active == "" {
+		return
+	}
+
+	cacheFile, signature := promptCacheKey(configFile, active, side)
+	prompt, ok := readPromptCache(cacheFile, signature)
+	if !ok {
+		var config ctx.Config
+		if err := ctx.ParseConfig(configFile, &config); err != nil {
+			return
+		}
+
+		prompt = renderPrompt(&config, active, side)
+		writePromptCache(cacheFile, signature, prompt)
+	}
+
+	if prompt != "" && exitStatus >= 0 {
+		prompt = statusMark(exitStatus) + prompt
+	}
+	fmt.Print(nonPrinting(prompt, shell))
+}
+
+// ansiEscape matches the color and cursor codes a prompt may hold.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// nonPrinting wraps the escape codes in prompt in the markers bash and zsh
+// need to leave them out of the width of the prompt, so line editing stays
+// aligned. fish and an empty shell get prompt as it is.
+func nonPrinting(prompt, shell string) string {
+	switch shell {
+	case "bash":
+		return ansiEscape.ReplaceAllString(prompt, `\[${0}\]`)
+	case "zsh":
+		return ansiEscape.ReplaceAllString(prompt, `%{${0}%}`)
+	}
+
+	return prompt
+}
+
+// statusMark returns a mark for the exit status of the last command, green
+// for success and red with the status otherwise. The prompt is read by the
+// shell rather than printed to a terminal, so only NO_COLOR and TERM decide
+// whether it is colored.
+func statusMark(status int) string {
+	mark, color := "✓ ", colorGreen
+	if status != 0 {
+		mark, color = fmt.Sprintf("✗ %d ", status), colorRed
+	}
+
+	if !colorAllowed() {
+		return mark
+	}
+
+	return "\x1b[" + color + "m" + mark + "\x1b[0m"
+}
+
+// renderPrompt returns the prompt for side of the context at the full path
+// active, preceded by those of its ancestors when it sets prompt_inherit. A
+// prompt that is not empty is wrapped in prompt_prefix and prompt_suffix, of
+// the nearest context along the path setting them or else of config.
+func renderPrompt(config *ctx.Config, active, side string) string {
+	contexts, err := ctx.FindPath(config, active)
+	if err != nil {
+		return ""
+	}
+
+	var prompt strings.Builder
+	c := contexts[len(contexts)-1]
+	if c.PromptInherit != nil && *c.PromptInherit {
+		for _, ancestor := range contexts[:len(contexts)-1] {
+			if p := promptOf(ancestor, side); p != nil {
+				prompt.WriteString(*p)
+			}
+		}
+	}
+
+	if p := promptOf(c, side); p != nil {
+		prompt.WriteString(*p)
+	}
+
+	if prompt.Len() == 0 {
+		return ""
+	}
+
+	prefix, suffix := config.PromptPrefix, config.PromptSuffix
+	for _, c := range contexts {
+		if c.PromptPrefix != nil {
+			prefix = c.PromptPrefix
+		}
+		if c.PromptSuffix != nil {
+			suffix = c.PromptSuffix
+		}
+	}
+
+	var wrapped string
+	if prefix != nil {
+		wrapped = *prefix
+	}
+	wrapped += prompt.String()
+	if suffix != nil {
+		wrapped += *suffix
+	}
+
+	return wrapped
+}
+
+// promptOf returns the prompt c defines for side. The left side falls back to
+// prompt, so a context without prompt_left shows the same on either.
+func promptOf(c *ctx.Context, side string) *string {
+	switch side {
+	case "left":
+		if c.PromptLeft != nil {
+			return c.PromptLeft
+		}
+	case "right":
+		return c.PromptRight
+	}
+
+	return c.Prompt
+}
+
+// promptCacheKey returns the cache file of the prompt for side of active and
+// the signature of the config files it was rendered from, their names, sizes
+// and modification times. An empty file is returned when there is no cache.
+func promptCacheKey(configFile, active, side string) (string, string) {
+	dir, err := ctx.CacheDir()
+	if err != nil {
+		return "", ""
+	}
+
+	files, err := ctx.ConfigFiles(configFile)
+	if err != nil {
+		return "", ""
+	}
+
+	var signature strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", ""
+		}
+		fmt.Fprintf(&signature, "%s %d %d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+
+	sum := sha256.Sum256([]byte(active + "\x00" + configFile + "\x00" + side))
+	return filepath.Join(dir, "prompt", hex.EncodeToString(sum[:])), signature.String()
+}
+
+// readPromptCache returns the prompt cached in file when it was rendered from
+// config files matching signature.
+func readPromptCache(file, signature string) (string, bool) {
+	if file == "" {
+		return "", false
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", false
+	}
+
+	cached, prompt, ok := bytes.Cut(content, []byte("\n"))
+	if !ok || string(cached) != signature {
+		return "", false
+	}
+
+	return string(prompt), true
+}
+
+// writePromptCache caches prompt in file. Failing to is not worth a warning
+// on every redraw, the prompt is rendered again next time.
+func writePromptCache(file, signature, prompt string) {
+	if file == "" {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return
+	}
+
+	os.WriteFile(file, []byte(signature+"\n"+prompt), 0600)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// runInPty fails, as there are no pseudo terminals on this platform.
+func runInPty(cmd *exec.Cmd) error {
+	return errors.New("--interactive needs a pseudo terminal, which this platform does not have")
+}
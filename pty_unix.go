@@ -0,0 +1,53 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/creack/pty"
+	"golang.org/x/term"
+)
+
+// runInPty runs cmd on a new pseudo terminal and copies between it and the
+// stdio of ctx until cmd exits. A terminal on stdin is put into raw mode
+// meanwhile, and its size is passed on.
+func runInPty(cmd *exec.Cmd) error {
+	// pty.Start only connects what is not connected yet
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, nil, nil
+
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return err
+	}
+	defer ptmx.Close()
+
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		resize := make(chan os.Signal, 1)
+		signal.Notify(resize, syscall.SIGWINCH)
+		defer func() {
+			signal.Stop(resize)
+			close(resize)
+		}()
+		go func() {
+			for range resize {
+				pty.InheritSize(os.Stdin, ptmx)
+			}
+		}()
+		resize <- syscall.SIGWINCH
+
+		if state, err := term.MakeRaw(fd); err == nil {
+			defer term.Restore(fd, state)
+		}
+	}
+
+	go io.Copy(ptmx, os.Stdin)
+
+	// the copy ends with an error once cmd exits and the terminal is gone
+	io.Copy(os.Stdout, ptmx)
+	return cmd.Wait()
+}
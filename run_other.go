@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+// replaceProcess runs args in envs and waits for it, as a process can not be
+// replaced on this platform.
+func replaceProcess(args, envs []string) error {
+	return execute(args, envs)
+}
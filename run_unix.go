@@ -0,0 +1,40 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// replaceProcess replaces ctx with args, run in envs. It only returns when
+// that fails.
+func replaceProcess(args, envs []string) error {
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+
+	return syscall.Exec(path, args, dedupeEnv(envs))
+}
+
+// dedupeEnv returns envs with a single entry for every name, holding its
+// last value. os/exec does the same for the processes it starts, but
+// syscall.Exec hands duplicates to the program, which may read either.
+func dedupeEnv(envs []string) []string {
+	index := make(map[string]int, len(envs))
+	deduped := make([]string, 0, len(envs))
+	for _, kv := range envs {
+		name, _, _ := strings.Cut(kv, "=")
+		if i, ok := index[name]; ok {
+			deduped[i] = kv
+			continue
+		}
+
+		index[name] = len(deduped)
+		deduped = append(deduped, kv)
+	}
+
+	return deduped
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const bashInit = `__ctx_ps1=$PS1
+__ctx_update_ps1() {
+	local prompt
+	prompt=$(%[1]s prompt --shell bash)
+	if [[ -n $prompt ]]; then
+		PS1=$prompt
+	else
+		PS1=$__ctx_ps1
+	fi
+}
+PROMPT_COMMAND="__ctx_update_ps1${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
+`
+
+const zshInit = `__ctx_ps1=$PROMPT
+__ctx_rps1=$RPROMPT
+__ctx_update_prompt() {
+	local prompt
+	prompt=$(%[1]s prompt --shell zsh --side left)
+	if [[ -n $prompt ]]; then
+		PROMPT=$prompt
+	else
+		PROMPT=$__ctx_ps1
+	fi
+	prompt=$(%[1]s prompt --shell zsh --side right)
+	if [[ -n $prompt ]]; then
+		RPROMPT=$prompt
+	else
+		RPROMPT=$__ctx_rps1
+	fi
+}
+typeset -ga precmd_functions
+precmd_functions+=(__ctx_update_prompt)
+`
+
+const fishInit = `if not functions -q __ctx_fish_prompt
+	functions -c fish_prompt __ctx_fish_prompt
+end
+function fish_prompt
+	set -l prompt (%[1]s prompt --shell fish | string collect)
+	if test -n "$prompt"
+		printf '%%s' $prompt
+	else
+		__ctx_fish_prompt
+	end
+end
+`
+
+// handleShellInit prints the rc snippet wiring ctx prompt into the prompt of
+// shell.
+func handleShellInit(shell string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+
+	switch shell {
+	case "bash":
+		fmt.Printf(bashInit, posixQuote(executable))
+	case "zsh":
+		fmt.Printf(zshInit, posixQuote(executable))
+	case "fish":
+		fmt.Printf(fishInit, fishQuote(executable))
+	case "":
+		return errors.New("which shell should be initialized, one of bash, zsh or fish")
+	default:
+		return fmt.Errorf("unsupported shell %s, one of bash, zsh or fish", shell)
+	}
+
+	return nil
+}
+
+func posixQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "os"
+
+// windowHeight is unknown on this platform.
+func windowHeight(f *os.File) int {
+	return 0
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// set at build time with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = ""
+	commit  = ""
+)
+
+func handleVersion() {
+	v, c := version, commit
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+
+		for _, setting := range info.Settings {
+			if c == "" && setting.Key == "vcs.revision" {
+				c = setting.Value
+			}
+		}
+	}
+
+	if v == "" {
+		v = "dev"
+	}
+
+	if c == "" {
+		c = "unknown"
+	}
+
+	fmt.Printf("ctx %s (commit %s, %s %s/%s)\n", v, c, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}